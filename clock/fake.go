@@ -0,0 +1,119 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake 只在调用Advance时前进的Clock
+//
+// 与time.Ticker一致，Ticker的channel缓冲为1，消费者来不及处理时多余的tick会被丢弃
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+var _ Clock = (*Fake)(nil)
+
+// fakeWaiter Ticker或After的等待者
+type fakeWaiter struct {
+	next   time.Time
+	period time.Duration //0表示只触发一次
+	c      chan time.Time
+	fake   *Fake
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return f.addWaiter(d, d)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.addWaiter(d, 0).c
+}
+
+func (f *Fake) addWaiter(d, period time.Duration) *fakeWaiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := &fakeWaiter{
+		next:   f.now.Add(d),
+		period: period,
+		c:      make(chan time.Time, 1),
+		fake:   f,
+	}
+	f.waiters = append(f.waiters, w)
+	return w
+}
+
+// Waiters 返回尚未停止的Ticker和After数量，可用于等待被测代码创建定时器
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// Advance 将时间前进d，期间到期的Ticker和After按时间顺序触发
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	target := f.now.Add(d)
+	for {
+		w := f.earliest()
+		if w == nil || w.next.After(target) {
+			break
+		}
+		f.now = w.next
+		select {
+		case w.c <- f.now:
+		default:
+		}
+		if w.period > 0 {
+			w.next = w.next.Add(w.period)
+		} else {
+			f.remove(w)
+		}
+	}
+	f.now = target
+}
+
+func (f *Fake) earliest() *fakeWaiter {
+	var earliest *fakeWaiter
+	for _, w := range f.waiters {
+		if earliest == nil || w.next.Before(earliest.next) {
+			earliest = w
+		}
+	}
+	return earliest
+}
+
+func (f *Fake) remove(w *fakeWaiter) {
+	for i, waiter := range f.waiters {
+		if waiter == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+func (w *fakeWaiter) Stop() {
+	w.fake.mu.Lock()
+	defer w.fake.mu.Unlock()
+	w.fake.remove(w)
+}
@@ -0,0 +1,63 @@
+package syncmember_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ciiim/syncmember"
+	"github.com/ciiim/syncmember/clock"
+	"github.com/ciiim/syncmember/transport"
+)
+
+// advanceUntil 每次将fake前进step，直到cond成立
+// 每步之间短暂让出，使被触发的协程和内存网络完成投递
+func advanceUntil(t *testing.T, fake *clock.Fake, step time.Duration, maxSteps int, cond func() bool, msg string) {
+	t.Helper()
+	for i := 0; i < maxSteps; i++ {
+		if cond() {
+			return
+		}
+		fake.Advance(step)
+		time.Sleep(2 * time.Millisecond)
+	}
+	if !cond() {
+		t.Fatal(msg)
+	}
+}
+
+func TestFakeClockFailureDetection(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	nodes := newMemCluster(t, transport.NewMemNetwork(), 3, func(c *syncmember.Config) {
+		c.SetClock(fake).
+			SetPingInterval(time.Second).
+			SetGossipInterval(100 * time.Millisecond).
+			SetPushPullInterval(time.Minute)
+	})
+
+	advanceUntil(t, fake, 100*time.Millisecond, 200, func() bool {
+		for _, s := range nodes {
+			if aliveMembers(s) != len(nodes)-1 {
+				return false
+			}
+		}
+		return true
+	}, "cluster did not converge")
+
+	delegates := make([]*countingDelegate, 2)
+	for i := range delegates {
+		delegates[i] = &countingDelegate{}
+		nodes[i].SetNodeDelegate(delegates[i])
+	}
+	nodes[2].Shutdown()
+
+	// 默认可信度为3，数个Ping周期内即可判定死亡，无需真实等待
+	advanceUntil(t, fake, 100*time.Millisecond, 1000, func() bool {
+		return delegates[0].dead.Load() > 0 && delegates[1].dead.Load() > 0
+	}, "shutdown node was not detected as dead")
+
+	for i := 0; i < 2; i++ {
+		if n := aliveMembers(nodes[i]); n != 1 {
+			t.Errorf("node%d: %d alive members, want 1", i, n)
+		}
+	}
+}
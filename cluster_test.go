@@ -0,0 +1,146 @@
+package syncmember_test
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/ciiim/syncmember"
+	"github.com/ciiim/syncmember/clock"
+	"github.com/ciiim/syncmember/transport"
+)
+
+// newMemCluster 在同一个MemNetwork中启动n个节点，并让它们加入第一个节点
+func newMemCluster(t *testing.T, network *transport.MemNetwork, n int, configure func(*syncmember.Config)) []*syncmember.SyncMember {
+	t.Helper()
+	nodes := make([]*syncmember.SyncMember, n)
+	for i := 0; i < n; i++ {
+		nodes[i] = newMemNode(t, network, i, configure)
+	}
+	for i := 1; i < n; i++ {
+		if err := nodes[i].Join(nodes[0].Node().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nodes
+}
+
+// newMemNode 在MemNetwork中启动第i个节点，地址为127.0.0.1:20000+i
+func newMemNode(t *testing.T, network *transport.MemNetwork, i int, configure func(*syncmember.Config)) *syncmember.SyncMember {
+	t.Helper()
+	addr := fmt.Sprintf("127.0.0.1:%d", 20000+i)
+	tr, err := network.NewTransport(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := syncmember.DefaultConfig().
+		SetAdvertiserIP("127.0.0.1").
+		SetPort(20000 + i).
+		SetTransport(tr).
+		SetLogLevel(slog.LevelError).
+		SetPingInterval(400 * time.Millisecond).
+		SetGossipInterval(50 * time.Millisecond).
+		SetPushPullInterval(time.Second)
+	config.PushPullNums = 1
+	if configure != nil {
+		configure(config)
+	}
+	s := syncmember.NewSyncMember(fmt.Sprintf("node%d", i), config)
+	if s == nil {
+		t.Fatalf("create node%d failed", i)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Run()
+		close(done)
+	}()
+	// 测试结束前等待节点停止
+	t.Cleanup(func() {
+		s.Shutdown()
+		<-done
+	})
+	return s
+}
+
+func aliveMembers(s *syncmember.SyncMember) int {
+	alive := 0
+	for _, n := range s.Members() {
+		// 节点状态由nMutex保护，需要通过GetNodeState读取
+		if s.GetNodeState(n.Addr().String()) == syncmember.NodeAlive {
+			alive++
+		}
+	}
+	return alive
+}
+
+// waitFor 在timeout内轮询cond
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestMemClusterConverge 由fake时钟驱动，时间推进不依赖机器负载
+// 节点过多时fake时间会快于数据包的处理而误判死亡，因此只使用较小的集群
+func TestMemClusterConverge(t *testing.T) {
+	size := 16
+	if testing.Short() {
+		size = 8
+	}
+	fake := clock.NewFake(time.Now())
+	nodes := newMemCluster(t, transport.NewMemNetwork(), size, func(c *syncmember.Config) {
+		c.SetClock(fake)
+	})
+
+	advanceUntil(t, fake, 50*time.Millisecond, 2000, func() bool {
+		for _, s := range nodes {
+			if aliveMembers(s) != size-1 {
+				return false
+			}
+		}
+		return true
+	}, "cluster did not converge")
+}
+
+func TestMixedProtocolVersions(t *testing.T) {
+	network := transport.NewMemNetwork()
+	nodes := []*syncmember.SyncMember{
+		newMemNode(t, network, 0, nil),
+		newMemNode(t, network, 1, nil),
+		// 滚动升级中仍使用复合数据包版本的节点
+		newMemNode(t, network, 2, func(c *syncmember.Config) {
+			c.SetProtocolVersion(2)
+		}),
+	}
+	for _, s := range nodes[1:] {
+		if err := s.Join(nodes[0].Node().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitConverged(t, nodes, 5*time.Second)
+
+	// 有节点未使用KVBatch时批量写入被拒绝
+	err := nodes[0].ApplyBatch([]syncmember.KVOp{{Type: syncmember.KVOpPut, Key: "batch", Value: []byte("v")}})
+	if !errors.Is(err, syncmember.ErrKVBatchUnsupported) {
+		t.Fatalf("ApplyBatch: unexpected error %v", err)
+	}
+
+	// 普通写入仍可以通过Gossip到达所有节点
+	nodes[0].SetKV("key", []byte("v0"))
+	nodes[2].SetKV("legacy", []byte("v2"))
+	waitFor(t, 5*time.Second, func() bool {
+		for _, s := range nodes {
+			if string(s.GetValue("key")) != "v0" || string(s.GetValue("legacy")) != "v2" {
+				return false
+			}
+		}
+		return true
+	}, "writes did not reach every node")
+}
@@ -1,12 +1,16 @@
 package syncmember
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"os"
 	"time"
+
+	"github.com/ciiim/syncmember/clock"
+	"github.com/ciiim/syncmember/transport"
 )
 
 var (
@@ -25,13 +29,21 @@ var (
 	NormalGossipInterval  = 400 * time.Millisecond
 	SlowGossipInterval    = 1 * time.Second
 	DefaultGossipInterval = NormalGossipInterval
+
+	DefaultExpireInterval   = 1 * time.Second
+	DefaultSnapshotInterval = 10 * time.Minute
 	///
 
 	//Ping and Goosip
 	DefaultFanout        = 3
+	DefaultCredibility   = int32(3)
 	DefaultUDPBufferSize = 1500
 	DefaultPushPullNums  = 1
 
+	//KV
+	DefaultTombstoneGracePeriod = 24 * time.Hour
+	DefaultMaxClockSkew         = 1 * time.Minute
+
 	//Net
 	DefaultTCPTimeout = 5 * time.Second
 	BindAllIP         = net.ParseIP("0.0.0.0")
@@ -69,7 +81,61 @@ type Config struct {
 	Fanout       int
 	PushPullNums int
 
+	//连续多少轮Ping未收到Pong后判定节点死亡
+	Credibility int32
+
 	UDPBufferSize int
+
+	//节点身份私钥，为空时随机生成
+	//节点重启后若希望保持身份不变，需要使用同一私钥
+	PrivateKey ed25519.PrivateKey
+
+	//节点元数据，随成员信息一同签名发布
+	Meta []byte
+
+	//校验Packet.From与UDP源地址
+	SenderCheck SenderCheckMode
+	//声明地址 ip:port -> 允许的源地址（ip:port 或 ip）
+	SenderAllowList map[string][]string
+
+	//集群标签，用于隔离同一网络中的多个集群
+	//UDP数据包和pushPull请求都会携带该标签，标签不一致的请求会被拒绝
+	ClusterLabel string
+
+	//集群共享密钥，设置后pushPull双方需要互相通过HMAC挑战才能合并节点信息
+	JoinSecret []byte
+
+	//本节点使用的最高协议版本，滚动升级时可以先设置为旧版本
+	ProtocolVersion uint8
+
+	//节点间通信方式，为空时使用UDP和TCP
+	//使用transport.MemTransport时，其地址需要与广播地址一致
+	Transport transport.Transport
+
+	//时间来源，为空时使用系统时间
+	//测试时可以使用clock.Fake按需推进时间
+	Clock clock.Clock
+
+	//检查KV是否过期的间隔
+	ExpireInterval time.Duration
+
+	//删除KV后墓碑的最长保留时间
+	//所有存活节点都已同步到墓碑时会提前清理
+	TombstoneGracePeriod time.Duration
+
+	//远程写入的时间戳最多比本地时间超前多少，超过时拒绝该写入
+	//避免时钟错误或恶意的节点把混合逻辑时钟推到遥远的未来
+	MaxClockSkew time.Duration
+
+	//KV数据目录，为空时不持久化
+	//启动时从该目录恢复KV数据，之后的修改写入预写日志
+	DataDir string
+	//KV快照的间隔，快照后截断预写日志
+	SnapshotInterval time.Duration
+
+	//KV数据的存储，为空时使用内存中的B树
+	//使用OpenDiskKVStore时数据保存在磁盘上，不受内存限制，且重启后保留，不需要再设置DataDir
+	KVStore KVStore
 }
 
 var (
@@ -90,9 +156,18 @@ var (
 			LogLevel:  DefaultLogLevel,
 			LogWriter: DefaultLogWriter,
 
-			Fanout: DefaultFanout,
+			Fanout:      DefaultFanout,
+			Credibility: DefaultCredibility,
 
 			UDPBufferSize: DefaultUDPBufferSize,
+
+			ProtocolVersion: ProtocolVersionMax,
+
+			ExpireInterval:       DefaultExpireInterval,
+			TombstoneGracePeriod: DefaultTombstoneGracePeriod,
+			MaxClockSkew:         DefaultMaxClockSkew,
+
+			SnapshotInterval: DefaultSnapshotInterval,
 		}
 
 	}
@@ -116,8 +191,17 @@ var (
 
 			Fanout:       DefaultFanout,
 			PushPullNums: DefaultPushPullNums,
+			Credibility:  DefaultCredibility,
 
 			UDPBufferSize: DefaultUDPBufferSize,
+
+			ProtocolVersion: ProtocolVersionMax,
+
+			ExpireInterval:       DefaultExpireInterval,
+			TombstoneGracePeriod: DefaultTombstoneGracePeriod,
+			MaxClockSkew:         DefaultMaxClockSkew,
+
+			SnapshotInterval: DefaultSnapshotInterval,
 		}
 	}
 )
@@ -142,16 +226,46 @@ func (s *SyncMember) readConfig(config *Config) error {
 		return fmt.Errorf("invalid bind ip or port")
 	}
 
+	if config.Credibility <= 0 {
+		config.Credibility = DefaultCredibility
+	}
+	if config.ProtocolVersion == 0 {
+		config.ProtocolVersion = ProtocolVersionMax
+	}
+	if err := checkProtocolVersion(config.ProtocolVersion); err != nil {
+		return err
+	}
+
+	if config.ExpireInterval <= 0 {
+		config.ExpireInterval = DefaultExpireInterval
+	}
+	if config.TombstoneGracePeriod <= 0 {
+		config.TombstoneGracePeriod = DefaultTombstoneGracePeriod
+	}
+	if config.MaxClockSkew <= 0 {
+		config.MaxClockSkew = DefaultMaxClockSkew
+	}
+	if config.SnapshotInterval <= 0 {
+		config.SnapshotInterval = DefaultSnapshotInterval
+	}
+
 	if config.AdvertiseIP == nil {
 		config.AdvertiseIP = getHostIP()
 	}
 
 	s.host = resolveAddr(fmt.Sprintf("%s:%d", config.AdvertiseIP.String(), config.AdvertisePort))
 
+	if config.Clock == nil {
+		config.Clock = clock.Real{}
+	}
+	s.clock = config.Clock
+
 	s.logger = initLogger(config)
-	s.pingTicker = time.NewTicker(config.PingInterval)
-	s.pushPullTicker = time.NewTicker(config.PushPullInterval)
-	s.gossipTicker = time.NewTicker(config.GossipInterval)
+	s.pingTicker = s.clock.NewTicker(config.PingInterval)
+	s.pushPullTicker = s.clock.NewTicker(config.PushPullInterval)
+	s.gossipTicker = s.clock.NewTicker(config.GossipInterval)
+	s.expireTicker = s.clock.NewTicker(config.ExpireInterval)
+	s.snapshotTicker = s.clock.NewTicker(config.SnapshotInterval)
 
 	return nil
 }
@@ -212,7 +326,91 @@ func (c *Config) SetFanout(fanout int) *Config {
 	return c
 }
 
+func (c *Config) SetCredibility(credibility int32) *Config {
+	c.Credibility = credibility
+	return c
+}
+
 func (c *Config) SetUDPBufferSize(size int) *Config {
 	c.UDPBufferSize = size
 	return c
 }
+
+func (c *Config) SetPrivateKey(key ed25519.PrivateKey) *Config {
+	c.PrivateKey = key
+	return c
+}
+
+func (c *Config) SetMeta(meta []byte) *Config {
+	c.Meta = meta
+	return c
+}
+
+func (c *Config) SetSenderCheck(mode SenderCheckMode) *Config {
+	c.SenderCheck = mode
+	return c
+}
+
+// AllowSenderTranslation 允许声明为advertise的节点从sources发送数据包
+func (c *Config) AllowSenderTranslation(advertise string, sources ...string) *Config {
+	if c.SenderAllowList == nil {
+		c.SenderAllowList = make(map[string][]string)
+	}
+	c.SenderAllowList[advertise] = append(c.SenderAllowList[advertise], sources...)
+	return c
+}
+
+func (c *Config) SetClusterLabel(label string) *Config {
+	c.ClusterLabel = label
+	return c
+}
+
+func (c *Config) SetJoinSecret(secret []byte) *Config {
+	c.JoinSecret = secret
+	return c
+}
+
+func (c *Config) SetProtocolVersion(version uint8) *Config {
+	c.ProtocolVersion = version
+	return c
+}
+
+func (c *Config) SetTransport(t transport.Transport) *Config {
+	c.Transport = t
+	return c
+}
+
+func (c *Config) SetClock(clk clock.Clock) *Config {
+	c.Clock = clk
+	return c
+}
+
+func (c *Config) SetExpireInterval(d time.Duration) *Config {
+	c.ExpireInterval = d
+	return c
+}
+
+func (c *Config) SetTombstoneGracePeriod(d time.Duration) *Config {
+	c.TombstoneGracePeriod = d
+	return c
+}
+
+func (c *Config) SetMaxClockSkew(d time.Duration) *Config {
+	c.MaxClockSkew = d
+	return c
+}
+
+func (c *Config) SetDataDir(dir string) *Config {
+	c.DataDir = dir
+	return c
+}
+
+func (c *Config) SetSnapshotInterval(d time.Duration) *Config {
+	c.SnapshotInterval = d
+	return c
+}
+
+func (c *Config) SetKVStore(store KVStore) *Config {
+	c.KVStore = store
+	return c
+}
@@ -10,7 +10,7 @@ type NodeEventDelegate interface {
 	// 当已存在的节点变为存活时被调用
 	NotifyAlive(n *Node)
 
-	// 当已存在的节点变为死亡时被调用
+	// 当已存在的节点变为死亡或离开时被调用
 	NotifyDead(n *Node)
 }
 
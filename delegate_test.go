@@ -1,11 +1,12 @@
 package syncmember_test
 
 import (
-	"log/slog"
 	"testing"
 	"time"
 
 	"github.com/ciiim/syncmember"
+	"github.com/ciiim/syncmember/clock"
+	"github.com/ciiim/syncmember/transport"
 )
 
 type MyDelegate struct {
@@ -16,66 +17,63 @@ type MyDelegate struct {
 
 func NewMyDelegate() *MyDelegate {
 	return &MyDelegate{
-		Joined: make(chan struct{}),
-		Dead:   make(chan struct{}),
-		Alive:  make(chan struct{}),
+		Joined: make(chan struct{}, 1),
+		Dead:   make(chan struct{}, 1),
+		Alive:  make(chan struct{}, 1),
 	}
 }
 
 var _ syncmember.NodeEventDelegate = &MyDelegate{}
 
+// 回调在持有锁时调用，不能阻塞，事件已经在channel中时丢弃
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
 func (m *MyDelegate) NotifyJoin(n *syncmember.Node) {
-	m.Joined <- struct{}{}
+	notify(m.Joined)
 }
 
 func (m *MyDelegate) NotifyDead(n *syncmember.Node) {
-	m.Dead <- struct{}{}
+	notify(m.Dead)
 }
 func (m *MyDelegate) NotifyAlive(n *syncmember.Node) {
-	m.Alive <- struct{}{}
+	notify(m.Alive)
 }
 
 func TestDelegate(t *testing.T) {
-	s1 := syncmember.NewSyncMember("node1", syncmember.DefaultConfig().
-		SetPort(9001).SetLogLevel(slog.LevelInfo))
-	s2 := syncmember.NewSyncMember("node2", syncmember.DefaultConfig().
-		SetPort(9002).SetLogLevel(slog.LevelError))
-
-	defer s1.Shutdown()
-	defer s2.Shutdown()
+	fake := clock.NewFake(time.Now())
+	network := transport.NewMemNetwork()
+	configure := func(c *syncmember.Config) {
+		c.SetClock(fake)
+	}
+	s1 := newMemNode(t, network, 0, configure)
+	s2 := newMemNode(t, network, 1, configure)
 
 	delegate := NewMyDelegate()
-
 	s1.SetNodeDelegate(delegate)
 
-	go func() {
-		_ = s1.Run()
-	}()
-	go func() {
-		_ = s2.Run()
-	}()
-
 	//test join
-	go func() {
-		err := s2.Join("127.0.0.1:9001")
-		if err != nil {
-			t.Error(err)
-		}
-	}()
+	if err := s2.Join(s1.Node().String()); err != nil {
+		t.Fatal(err)
+	}
 	select {
 	case <-delegate.Joined:
-		break
-	case <-time.After(500 * time.Millisecond):
-		t.Errorf("Joined expected true but found false")
+	default:
+		t.Fatal("Joined expected true but found false")
 	}
 
 	//test dead
 	s2.Shutdown()
-	select {
-	case <-delegate.Dead:
-		break
-	case <-time.After(3000 * time.Millisecond):
-		t.Errorf("Dead expected true but found false")
-	}
-
+	advanceUntil(t, fake, 100*time.Millisecond, 1000, func() bool {
+		select {
+		case <-delegate.Dead:
+			return true
+		default:
+			return false
+		}
+	}, "Dead expected true but found false")
 }
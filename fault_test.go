@@ -0,0 +1,152 @@
+package syncmember_test
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ciiim/syncmember"
+	"github.com/ciiim/syncmember/clock"
+	"github.com/ciiim/syncmember/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingDelegate struct {
+	dead atomic.Int32
+}
+
+func (c *countingDelegate) NotifyJoin(n *syncmember.Node)  {}
+func (c *countingDelegate) NotifyAlive(n *syncmember.Node) {}
+func (c *countingDelegate) NotifyDead(n *syncmember.Node) {
+	c.dead.Add(1)
+}
+
+func waitConverged(t *testing.T, nodes []*syncmember.SyncMember, timeout time.Duration) {
+	t.Helper()
+	waitFor(t, timeout, func() bool {
+		for _, s := range nodes {
+			if aliveMembers(s) != len(nodes)-1 {
+				return false
+			}
+		}
+		return true
+	}, "cluster did not converge")
+}
+
+// TestNoFalseDeadUnderLoss 由fake时钟驱动固定的Ping轮数，结果不依赖机器负载
+// 连续Credibility轮Ping或Pong全部丢失才会判定死亡，10%丢包下不应出现误判
+func TestNoFalseDeadUnderLoss(t *testing.T) {
+	const (
+		pingInterval = 200 * time.Millisecond
+		step         = 25 * time.Millisecond
+		rounds       = 60
+	)
+	fake := clock.NewFake(time.Now())
+	network := transport.NewMemNetwork()
+	network.SetClock(fake)
+	nodes := newMemCluster(t, network, 5, func(c *syncmember.Config) {
+		c.SetClock(fake).
+			SetPingInterval(pingInterval).
+			SetFanout(4).
+			SetCredibility(8)
+	})
+	advanceUntil(t, fake, step, 400, func() bool {
+		for _, s := range nodes {
+			if aliveMembers(s) != len(nodes)-1 {
+				return false
+			}
+		}
+		return true
+	}, "cluster did not converge")
+
+	delegates := make([]*countingDelegate, len(nodes))
+	for i, s := range nodes {
+		delegates[i] = &countingDelegate{}
+		s.SetNodeDelegate(delegates[i])
+	}
+
+	network.SetFaults(transport.Faults{
+		Loss:      0.1,
+		Latency:   2 * time.Millisecond,
+		Jitter:    5 * time.Millisecond,
+		Duplicate: 0.05,
+		Reorder:   0.05,
+	})
+	for i := 0; i < rounds*int(pingInterval/step); i++ {
+		fake.Advance(step)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	for i, d := range delegates {
+		if n := d.dead.Load(); n != 0 {
+			t.Errorf("node%d: NotifyDead fired %d times under 10%% loss", i, n)
+		}
+	}
+}
+
+func TestMemNetworkLatencyOnClock(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	network := transport.NewMemNetwork()
+	network.SetClock(fake)
+	network.SetFaults(transport.Faults{Latency: time.Second})
+
+	start := func(addr string, handler func(*transport.Packet)) *transport.MemTransport {
+		tr, err := network.NewTransport(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tr.Start(handler, func(net.Conn) {}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { tr.Shutdown() })
+		return tr
+	}
+	received := make(chan struct{}, 1)
+	a := start("127.0.0.1:9201", func(*transport.Packet) {})
+	b := start("127.0.0.1:9202", func(*transport.Packet) { received <- struct{}{} })
+
+	// 延迟由fake计时，不推进时间就不会到达
+	assert.NoError(t, a.SendPacket([]byte("ping"), b.Addr()))
+	assert.Equal(t, 1, fake.Waiters())
+	fake.Advance(999 * time.Millisecond)
+	select {
+	case <-received:
+		t.Fatal("packet delivered before its latency elapsed")
+	default:
+	}
+
+	fake.Advance(time.Millisecond)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("packet not delivered after latency")
+	}
+}
+
+func TestPartitionHeal(t *testing.T) {
+	network := transport.NewMemNetwork()
+	nodes := newMemCluster(t, network, 6, func(c *syncmember.Config) {
+		c.SetPingInterval(50 * time.Millisecond)
+	})
+	waitConverged(t, nodes, 5*time.Second)
+
+	for i, s := range nodes {
+		network.SetGroup(fmt.Sprintf("group%d", i%2), s.Node().String())
+	}
+	network.PartitionBoth("group0", "group1")
+
+	// 分区后每个节点只能看到同组的两个节点
+	waitFor(t, 5*time.Second, func() bool {
+		for _, s := range nodes {
+			if aliveMembers(s) != 2 {
+				return false
+			}
+		}
+		return true
+	}, "partition was not detected")
+
+	network.HealAll()
+	waitConverged(t, nodes, 10*time.Second)
+}
@@ -7,7 +7,7 @@ import (
 func (s *SyncMember) gossip() {
 	for {
 		select {
-		case <-s.gossipTicker.C:
+		case <-s.gossipTicker.C():
 			s.doGossip()
 		case <-s.stopCh:
 			return
@@ -28,10 +28,20 @@ func (s *SyncMember) doGossip() {
 	nodes := kRamdonNodes(s.config.Fanout, s.nodes, func(n *Node) bool {
 		return !n.IsCredible()
 	})
+	//所有存活节点都支持时，将消息合并为一个数据包发送
+	var packets []*Packet
+	if s.supports(protocolCompound) {
+		packets = s.buildCompoundPackets(messages)
+	} else {
+		packets = make([]*Packet, len(messages))
+		for i, msg := range messages {
+			packets[i] = buildPacketMessageBytes(msg, s.host, Address{})
+		}
+	}
 	for _, node := range nodes {
-		for _, msgBytes := range messages { //XXX: 可以组装成一个包，无需多次发送
-			packet := buildPacketMessageBytes(msgBytes, s.host, node.Addr())
-			if err := sendPacket(s.udpTransport, packet); err != nil {
+		for _, packet := range packets {
+			packet.To = node.Addr()
+			if err := s.sendPacket(packet); err != nil {
 				s.logger.Error("SendMsg", "error", err)
 				continue
 			}
@@ -40,6 +50,64 @@ func (s *SyncMember) doGossip() {
 
 }
 
+// buildCompoundPackets 将消息按UDP缓冲区大小分组，每组合并为一个复合数据包
+func (s *SyncMember) buildCompoundPackets(messages []*Message) []*Packet {
+	packets := make([]*Packet, 0, 1)
+	flush := func(group []*Message) {
+		if len(group) == 0 {
+			return
+		}
+		if len(group) == 1 {
+			packets = append(packets, buildPacketMessageBytes(group[0], s.host, Address{}))
+			return
+		}
+		payload, err := codec.Marshal(group)
+		if err != nil {
+			s.logger.Error("buildCompoundPackets", "marshal error", err)
+			return
+		}
+		packet := buildPacketMessageBytes(newMessage(Compound, payload), s.host, Address{})
+		packet.Version = protocolCompound
+		packets = append(packets, packet)
+	}
+	group := make([]*Message, 0, len(messages))
+	size := compoundOverhead
+	for _, msg := range messages {
+		msgSize := len(msg.GetPayload()) + compoundMessageOverhead
+		if len(group) > 0 && size+msgSize > s.config.UDPBufferSize {
+			flush(group)
+			group = make([]*Message, 0, len(messages))
+			size = compoundOverhead
+		}
+		group = append(group, msg)
+		size += msgSize
+	}
+	flush(group)
+	return packets
+}
+
+const (
+	//数据包中地址、标签等字段的预留大小
+	compoundOverhead = 256
+	//每条消息类型、序号及编码的预留大小
+	compoundMessageOverhead = 16
+)
+
+// handleCompound 拆分复合消息，逐条交给对应的处理函数
+func (s *SyncMember) handleCompound(packet *Packet) {
+	var messages []*Message
+	if err := codec.Unmarshal(packet.MessageBody.Payload, &messages); err != nil {
+		s.logger.Error("handleCompound", "UDPUnmarshal error", err)
+		return
+	}
+	for _, msg := range messages {
+		if msg == nil || msg.MsgType == Compound {
+			continue
+		}
+		s.dispatchPacket(newPacket(msg, packet.From, packet.To))
+	}
+}
+
 func buildPacketMessageBytes(msg *Message, from, to Address) *Packet {
 	return newPacket(msg, from, to)
 }
@@ -50,28 +118,54 @@ func (s *SyncMember) handleGossip(packet *Packet) {
 	case Alive:
 		fallthrough
 	case Dead:
-		s.handleStateChange(packet.MessageBody)
+		s.handleStateChange(packet.MessageBody, packet.From)
 	case KVSet:
 		fallthrough
 	case KVDelete:
 		fallthrough
 	case KVUpdate:
 		s.handleKV(packet.MessageBody)
+	case KVBatch:
+		s.handleKVBatch(packet.MessageBody)
 	}
 }
 
-func (s *SyncMember) handleStateChange(msg *Message) {
+// from 为发送方，收到关于本节点的死亡通知时直接回复本节点签名的存活信息
+func (s *SyncMember) handleStateChange(msg *Message, from Address) {
 	nodeinfo := NodeInfoPayload{}
 	if err := codec.Unmarshal(msg.Payload, &nodeinfo); err != nil {
 		s.logger.Error("handleStateChange", "UDPUnmarshal error", err)
 		return
 	}
 
+	s.nMutex.Lock()
+	defer s.nMutex.Unlock()
 	switch msg.MsgType {
 	case Alive:
+		if !s.admitted(nodeinfo.Addr) {
+			s.logger.Debug("Reject alive claim", "node", nodeinfo.Addr.String(), "error", "not joined through pushPull")
+			return
+		}
 		s.alive(&nodeinfo)
 	case Dead:
 		s.dead(&nodeinfo)
+		if equalAddress(nodeinfo.Addr, s.me.address) {
+			s.answerDeadClaim(from)
+		}
+	}
+}
+
+// answerDeadClaim 发送方仍认为本节点死亡，Gossip不会发往它眼中的死亡节点，
+// 反驳只能直接发给它
+// 调用者需要持有nMutex
+func (s *SyncMember) answerDeadClaim(from Address) {
+	if _, ok := s.nodesMap[from.String()]; !ok || s.me.NodeState() != NodeAlive {
+		return
+	}
+	claim := s.me.signedInfo()
+	packet := newPacket(newMessage(Alive, claim.Encode().Bytes()), s.host, from)
+	if err := s.sendPacket(packet); err != nil {
+		s.logger.Error("SendMsg", "error", err)
 	}
 }
 
@@ -82,5 +176,15 @@ func (s *SyncMember) handleKV(msg *Message) {
 		return
 	}
 
-	s.kvOperation(msg.MsgType, &kv)
+	s.applyKV(msg.MsgType, &kv)
+}
+
+func (s *SyncMember) handleKVBatch(msg *Message) {
+	batch := KVBatchPayload{}
+	if err := batch.Decode(msg.Payload); err != nil {
+		s.logger.Error("handleKVBatch", "UDPUnmarshal error", err)
+		return
+	}
+
+	s.applyKVBatch(&batch)
 }
@@ -0,0 +1,64 @@
+package syncmember
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var ErrClockSkew = errors.New("remote timestamp too far ahead")
+
+// hlc 混合逻辑时钟
+//
+// 时间戳的高48位为物理时间(毫秒)，低16位为逻辑计数。
+// 本地写入时取物理时间与已见过的最大时间戳中较大者，
+// 收到远程时间戳后推进本地时钟，使之后的本地写入一定晚于已观察到的写入。
+type hlc struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+const hlcLogicalBits = 16
+
+func hlcPhysical(wall time.Time) uint64 {
+	return uint64(wall.UnixMilli()) << hlcLogicalBits
+}
+
+// now 返回一个新的本地时间戳
+func (h *hlc) now(wall time.Time) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if pt := hlcPhysical(wall); pt > h.last {
+		h.last = pt
+	} else if h.last < math.MaxUint64 {
+		h.last++
+	}
+	//已达到上限时不再递增，避免回绕到0
+	return h.last
+}
+
+// receive 观察到远程时间戳
+// 物理时间比wall超前maxSkew以上的时间戳来自时钟错误或恶意的节点，返回ErrClockSkew，不推进本地时钟
+func (h *hlc) receive(remote uint64, wall time.Time, maxSkew time.Duration) error {
+	if remote>>hlcLogicalBits > uint64(wall.Add(maxSkew).UnixMilli()) {
+		return fmt.Errorf("%w: %s is %s ahead", ErrClockSkew, hlcTime(remote).Format(time.RFC3339Nano), hlcTime(remote).Sub(wall))
+	}
+	h.update(remote)
+	return nil
+}
+
+// update 观察到本地保存的时间戳
+func (h *hlc) update(remote uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if remote > h.last {
+		h.last = remote
+	}
+}
+
+// hlcTime 返回时间戳的物理时间部分
+func hlcTime(ts uint64) time.Time {
+	return time.UnixMilli(int64(ts >> hlcLogicalBits))
+}
@@ -0,0 +1,92 @@
+package syncmember
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHLC(t *testing.T) {
+	var h hlc
+	wall := time.Now()
+	t1 := h.now(wall)
+	// 物理时间不前进时依靠逻辑计数保持递增
+	t2 := h.now(wall)
+	assert.Greater(t, t2, t1)
+
+	// 远程时钟更快时，之后的本地写入仍晚于远程写入
+	remote := hlcPhysical(wall.Add(time.Hour))
+	h.update(remote)
+	assert.Greater(t, h.now(wall), remote)
+}
+
+func TestHLCMaxSkew(t *testing.T) {
+	var h hlc
+	wall := time.Now()
+	local := h.now(wall)
+
+	// 超前过多的远程时间戳被拒绝，不推进本地时钟
+	err := h.receive(math.MaxUint64, wall, time.Minute)
+	assert.True(t, errors.Is(err, ErrClockSkew), "unexpected error %v", err)
+	err = h.receive(hlcPhysical(wall.Add(time.Hour)), wall, time.Minute)
+	assert.True(t, errors.Is(err, ErrClockSkew), "unexpected error %v", err)
+	assert.Equal(t, local+1, h.now(wall))
+
+	// 偏差以内的远程时间戳正常推进
+	remote := hlcPhysical(wall.Add(30 * time.Second))
+	assert.NoError(t, h.receive(remote, wall, time.Minute))
+	assert.Greater(t, h.now(wall), remote)
+
+	// 超前的写入不会被合并
+	s := newTestMember(t, "127.0.0.1:9101")
+	kv := KeyValuePayload{Key: "key", Value: []byte("future"), Timestamp: math.MaxUint64, Origin: "node2"}
+	s.applyKV(KVSet, &kv)
+	assert.Nil(t, s.GetValue("key"))
+	s.SetKV("key", []byte("local"))
+	_, version, _ := s.GetWithVersion("key")
+	assert.Less(t, version, hlcPhysical(time.Now().Add(time.Minute)))
+}
+
+func TestHLCOverflow(t *testing.T) {
+	h := hlc{last: math.MaxUint64 - 1}
+	wall := time.Now()
+	assert.Equal(t, uint64(math.MaxUint64), h.now(wall))
+	// 达到上限后不回绕到0
+	assert.Equal(t, uint64(math.MaxUint64), h.now(wall))
+}
+
+func TestKVLastWriterWins(t *testing.T) {
+	ts := hlcPhysical(time.Now())
+	writes := []KeyValuePayload{
+		{Key: "key", Value: []byte("old"), Timestamp: ts, Origin: "node1"},
+		{Key: "key", Value: []byte("new"), Timestamp: ts + 1, Origin: "node1"},
+		// 时间戳相同时由写入节点决定
+		{Key: "key", Value: []byte("tie"), Timestamp: ts + 1, Origin: "node2"},
+	}
+
+	forward := newTestMember(t, "127.0.0.1:9101")
+	for i := range writes {
+		kv := writes[i]
+		forward.applyKV(KVSet, &kv)
+	}
+	backward := newTestMember(t, "127.0.0.1:9102")
+	for i := len(writes) - 1; i >= 0; i-- {
+		kv := writes[i]
+		backward.applyKV(KVUpdate, &kv)
+	}
+	assert.Equal(t, "tie", string(forward.GetValue("key")))
+	assert.Equal(t, "tie", string(backward.GetValue("key")))
+
+	// 早于当前值的删除被忽略
+	stale := KeyValuePayload{Key: "key", Timestamp: ts, Origin: "node1"}
+	forward.applyKV(KVDelete, &stale)
+	assert.Equal(t, "tie", string(forward.GetValue("key")))
+
+	// 本地写入晚于已观察到的所有写入
+	forward.UpdateKV("key", []byte("local"))
+	backward.mergeKV(forward.leafKVs([]uint32{merkleLeaf("key")}))
+	assert.Equal(t, "local", string(backward.GetValue("key")))
+}
@@ -0,0 +1,194 @@
+package syncmember
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/ciiim/syncmember/codec"
+)
+
+var (
+	ErrUnsignedNodeInfo  = errors.New("node info is not signed")
+	ErrInvalidSignature  = errors.New("invalid node info signature")
+	ErrUnknownSigner     = errors.New("unknown node info signer")
+	ErrPublicKeyMismatch = errors.New("node public key mismatch")
+	ErrUntrustedSigner   = errors.New("untrusted node info signer")
+	ErrVersionJump       = errors.New("node info version jumps too far")
+)
+
+// 死亡通知的版本最多比本地版本高出的值
+// 正常的死亡通知由发现者在其本地版本上加一，各节点的本地版本只会因反驳和元数据更新而短暂落后
+const maxDeadVersionJump = 8
+
+// identity 节点身份
+// 每个节点持有一对ed25519密钥，公钥随成员信息一同发布，
+// 节点关于自身的状态变更（Alive、反驳、元数据）都需要由自己签名
+type identity struct {
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+// newIdentity 使用给定的私钥创建身份，私钥为空时随机生成
+func newIdentity(privateKey ed25519.PrivateKey) (*identity, error) {
+	if privateKey == nil {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = priv
+	}
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid private key size %d", len(privateKey))
+	}
+	return &identity{
+		publicKey:  privateKey.Public().(ed25519.PublicKey),
+		privateKey: privateKey,
+	}, nil
+}
+
+// sign 以signer的身份对节点信息签名
+func (i *identity) sign(p *NodeInfoPayload, signer Address) {
+	p.Signer = signer
+	p.Signature = ed25519.Sign(i.privateKey, p.signingBytes())
+}
+
+// signingBytes 返回参与签名的字节，即不含签名字段的编码
+func (p *NodeInfoPayload) signingBytes() []byte {
+	unsigned := *p
+	unsigned.Signature = nil
+	b, err := codec.Marshal(&unsigned)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (p *NodeInfoPayload) verify(publicKey ed25519.PublicKey) error {
+	if len(p.Signature) == 0 {
+		return ErrUnsignedNodeInfo
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return ErrInvalidSignature
+	}
+	if !ed25519.Verify(publicKey, p.signingBytes(), p.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// isSelfClaim 节点信息是否由节点自己签发
+func (p *NodeInfoPayload) isSelfClaim() bool {
+	return equalAddress(p.Addr, p.Signer)
+}
+
+// verified 节点信息是否与已校验过的信息相同
+func (n *Node) verified(nodeInfo *NodeInfoPayload) bool {
+	if len(nodeInfo.Signature) == 0 {
+		return false
+	}
+	for _, claim := range []*NodeInfoPayload{&n.claim, &n.selfClaim} {
+		// 签名相同时还需要比较内容，防止签名被挪用到篡改过的信息上
+		if bytes.Equal(claim.Signature, nodeInfo.Signature) && bytes.Equal(claim.signingBytes(), nodeInfo.signingBytes()) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyNodeInfo 校验收到的节点信息
+//
+// Alive 和 Left 必须由节点自己签名，公钥在首次见到节点时固定，
+// 之后只有在本地认为该节点已死亡或离开时才允许更换（节点重启后生成了新密钥）。
+//
+// Dead 只能由可信成员签名，即公钥经由pushPull确认过的成员，仅通过Gossip得知的公钥不能签发死亡通知，
+// 且版本不能比本地版本高出maxDeadVersionJump以上。
+func (s *SyncMember) verifyNodeInfo(p *NodeInfoPayload) error {
+	// 重复收到的信息无需再次校验
+	if node, ok := s.nodesMap[p.Addr.String()]; ok && node.verified(p) {
+		return nil
+	}
+	if p.isSelfClaim() {
+		if err := p.verify(p.PublicKey); err != nil {
+			return err
+		}
+		if equalAddress(p.Addr, s.me.address) {
+			if !s.me.publicKey.Equal(ed25519.PublicKey(p.PublicKey)) {
+				return ErrPublicKeyMismatch
+			}
+			return nil
+		}
+		node, ok := s.nodesMap[p.Addr.String()]
+		if ok && node.publicKey != nil && !node.publicKey.Equal(ed25519.PublicKey(p.PublicKey)) {
+			if node.NodeState() == NodeAlive || p.Version <= node.GetInfo().Version {
+				return ErrPublicKeyMismatch
+			}
+		}
+		return nil
+	}
+
+	// 非节点自身签发的信息只能是死亡通知
+	if p.NodeState != NodeDead {
+		return fmt.Errorf("%w: %s claim about %s signed by %s", ErrInvalidSignature, p.NodeState, p.Addr, p.Signer)
+	}
+	if node, ok := s.nodesMap[p.Addr.String()]; ok && p.Version > node.GetInfo().Version+maxDeadVersionJump {
+		return fmt.Errorf("%w: %d, local %d", ErrVersionJump, p.Version, node.GetInfo().Version)
+	}
+	if equalAddress(p.Signer, s.me.address) {
+		return p.verify(s.me.publicKey)
+	}
+	signer, ok := s.nodesMap[p.Signer.String()]
+	if !ok || signer.publicKey == nil {
+		return ErrUnknownSigner
+	}
+	if err := p.verify(signer.publicKey); err != nil {
+		return err
+	}
+	if !signer.trusted {
+		return ErrUntrustedSigner
+	}
+	return nil
+}
+
+// trustClaims 把pushPull中收到的节点自身签发的信息标记为可信
+// peer为本节点主动连接的节点，其自身信息总是可信；vouched为true时列表中的其他节点同样可信
+// 调用者需要持有nMutex，且已经合并过这些信息
+func (s *SyncMember) trustClaims(remote []NodeInfoPayload, peer *Address, vouched bool) {
+	for i := range remote {
+		p := &remote[i]
+		if p.NodeState != NodeAlive || !p.isSelfClaim() {
+			continue
+		}
+		if !vouched && (peer == nil || !equalAddress(p.Addr, *peer)) {
+			continue
+		}
+		node, ok := s.nodesMap[p.Addr.String()]
+		if ok && node.publicKey.Equal(ed25519.PublicKey(p.PublicKey)) {
+			node.trusted = true
+		}
+	}
+}
+
+// signSelf 重新签发本节点的成员信息
+func (s *SyncMember) signSelf() NodeInfoPayload {
+	info := s.me.GetInfo()
+	s.identity.sign(&info, s.me.address)
+	s.me.claim = info
+	return info
+}
+
+// signDead 以本节点身份签发某节点的死亡通知
+func (s *SyncMember) signDead(node *Node) NodeInfoPayload {
+	info := node.GetInfo()
+	info.NodeState = NodeDead
+	s.identity.sign(&info, s.me.address)
+	node.claim = info
+	return info
+}
+
+// PublicKey 返回本节点的公钥
+func (s *SyncMember) PublicKey() ed25519.PublicKey {
+	return s.identity.publicKey
+}
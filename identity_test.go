@@ -0,0 +1,163 @@
+package syncmember
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/ciiim/syncmember/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMember(t *testing.T, addr string) *SyncMember {
+	t.Helper()
+	id, err := newIdentity(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SyncMember{
+		nMutex:         new(sync.Mutex),
+		nodesMap:       make(map[string]*Node),
+		waitPongMap:    make(map[string]*Node),
+		boardcastQueue: newBoardcastQueue(),
+		logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		identity:       id,
+		config:         DefaultConfig(),
+		kvTreeMu:       new(sync.RWMutex),
+		clock:          clock.Real{},
+		kWatcher:       newKVWatcher(),
+	}
+	s.me = newNode(resolveAddr(addr), nil)
+	s.me.publicKey = id.publicKey
+	s.me.setAlive(DefaultCredibility)
+	s.signSelf()
+	return s
+}
+
+func TestSignedAliveClaim(t *testing.T) {
+	s1 := newTestMember(t, "127.0.0.1:9101")
+	s2 := newTestMember(t, "127.0.0.1:9102")
+
+	claim := s2.me.signedInfo()
+	s1.alive(&claim)
+	assert.Equal(t, NodeAlive, s1.GetNodeState(s2.me.Addr().String()))
+
+	// 篡改元数据后签名失效
+	forged := s2.me.signedInfo()
+	forged.Version++
+	forged.Meta = []byte("forged")
+	s1.alive(&forged)
+	assert.Nil(t, s1.nodesMap[s2.me.Addr().String()].Meta())
+
+	// 未签名的Alive
+	unsigned := s2.me.GetInfo()
+	unsigned.Version += 2
+	s1.alive(&unsigned)
+	assert.Equal(t, claim.Version, s1.nodesMap[s2.me.Addr().String()].GetInfo().Version)
+}
+
+func TestStaleAliveClaimKeepsNodeDead(t *testing.T) {
+	s1 := newTestMember(t, "127.0.0.1:9101")
+	s2 := newTestMember(t, "127.0.0.1:9102")
+
+	stale := s2.me.signedInfo()
+	s1.alive(&stale)
+	node := s1.nodesMap[s2.me.Addr().String()]
+	node.setDead()
+	s1.signDead(node)
+
+	// 判定死亡之前的存活信息仍在Gossip中传播，不能复活节点
+	s1.alive(&stale)
+	assert.Equal(t, NodeDead, s1.GetNodeState(s2.me.Addr().String()))
+
+	// 节点以死亡通知的版本反驳后复活
+	s2.me.increaseVersionTo(node.GetInfo().Version)
+	refute := s2.signSelf()
+	s1.alive(&refute)
+	assert.Equal(t, NodeAlive, s1.GetNodeState(s2.me.Addr().String()))
+	assert.Equal(t, refute, node.signedInfo())
+}
+
+func TestRejectForgedDeadClaim(t *testing.T) {
+	s1 := newTestMember(t, "127.0.0.1:9101")
+	s2 := newTestMember(t, "127.0.0.1:9102")
+	attacker := newTestMember(t, "127.0.0.1:9103")
+
+	claim := s2.me.signedInfo()
+	s1.alive(&claim)
+
+	// 未知节点签发的死亡通知
+	victim := newNode(s2.me.Addr(), &claim)
+	victim.increaseVersionTo(claim.Version + 1)
+	forged := attacker.signDead(victim)
+	s1.dead(&forged)
+	assert.Equal(t, NodeAlive, s1.GetNodeState(s2.me.Addr().String()))
+
+	// 已知成员签发的死亡通知
+	s3 := newTestMember(t, "127.0.0.1:9104")
+	s3claim := s3.me.signedInfo()
+	s1.alive(&s3claim)
+	s2.alive(&s3claim)
+	// s1通过pushPull确认了s2的公钥
+	s1.trustClaims([]NodeInfoPayload{claim}, &claim.Addr, false)
+	suspect := s2.nodesMap[s3.me.Addr().String()]
+	suspect.setDead()
+	dead := s2.signDead(suspect)
+	s1.dead(&dead)
+	assert.Equal(t, NodeDead, s1.GetNodeState(s3.me.Addr().String()))
+}
+
+func TestRejectDeadClaimFromUntrustedSigner(t *testing.T) {
+	s1 := newTestMember(t, "127.0.0.1:9101")
+	s2 := newTestMember(t, "127.0.0.1:9102")
+	stranger := newTestMember(t, "127.0.0.1:9103")
+
+	claim := s2.me.signedInfo()
+	s1.alive(&claim)
+
+	// 只通过Gossip发送过自身信息的节点，公钥虽被固定，但不能签发死亡通知
+	strangerClaim := stranger.me.signedInfo()
+	s1.alive(&strangerClaim)
+	victim := newNode(s2.me.Addr(), &claim)
+	victim.increaseVersionTo(claim.Version + 1)
+	forged := stranger.signDead(victim)
+	s1.dead(&forged)
+	assert.Equal(t, NodeAlive, s1.GetNodeState(s2.me.Addr().String()))
+
+	// 经由pushPull确认后，版本跳跃过大的死亡通知仍被拒绝
+	s1.trustClaims([]NodeInfoPayload{strangerClaim}, &strangerClaim.Addr, false)
+	victim.increaseVersionTo(claim.Version + 1000)
+	forged = stranger.signDead(victim)
+	s1.dead(&forged)
+	assert.Equal(t, NodeAlive, s1.GetNodeState(s2.me.Addr().String()))
+	assert.Equal(t, claim.Version, s1.nodesMap[s2.me.Addr().String()].GetInfo().Version)
+
+	// 被判定死亡的节点同样不采用跳跃过大的版本
+	s2.dead(&forged)
+	assert.Equal(t, claim.Version, s2.me.GetInfo().Version)
+}
+
+func TestTrustClaimsFromPushPull(t *testing.T) {
+	s1 := newTestMember(t, "127.0.0.1:9101")
+	s2 := newTestMember(t, "127.0.0.1:9102")
+	s3 := newTestMember(t, "127.0.0.1:9103")
+
+	remote := []NodeInfoPayload{s2.me.signedInfo(), s3.me.signedInfo()}
+	assert.NoError(t, s1.mergeNodes(remote, &remote[0].Addr, false))
+	assert.True(t, s1.nodesMap[s2.me.Addr().String()].trusted)
+	// 未经认证的对方转发的公钥不可信
+	assert.False(t, s1.nodesMap[s3.me.Addr().String()].trusted)
+
+	assert.NoError(t, s1.mergeNodes(remote, &remote[0].Addr, true))
+	assert.True(t, s1.nodesMap[s3.me.Addr().String()].trusted)
+
+	// 转发死亡通知时以本节点身份重新签发
+	s2.alive(&remote[1])
+	suspect := s2.nodesMap[s3.me.Addr().String()]
+	suspect.setDead()
+	dead := s2.signDead(suspect)
+	s1.dead(&dead)
+	assert.Equal(t, NodeDead, s1.GetNodeState(s3.me.Addr().String()))
+	assert.True(t, equalAddress(s1.me.Addr(), s1.nodesMap[s3.me.Addr().String()].signedInfo().Signer))
+}
@@ -2,19 +2,89 @@ package syncmember
 
 import (
 	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
 
 	"github.com/google/btree"
 )
 
+var ErrKVTooLarge = errors.New("kv entry too large")
+
+// checkKVSize 键和值的总长度超过maxKVEntryBytes时无法通过pushPull同步，写入时拒绝
+func checkKVSize(key string, value []byte) error {
+	if size := len(key) + len(value); size > maxKVEntryBytes {
+		return fmt.Errorf("%w: %q is %d bytes, limit %d", ErrKVTooLarge, key, size, maxKVEntryBytes)
+	}
+	return nil
+}
+
 func (s *SyncMember) lazyInit() {
-	if s.kvcopyTree == nil {
-		s.kvcopyTree = btree.New(32)
+	if s.kvStore != nil {
+		return
+	}
+	s.kvMerkle = newKVMerkle()
+	s.tombstones = make(map[string]*kVItem)
+	s.kvSyncedAt = make(map[string]uint64)
+	s.kvEphemeral = make(map[string]map[string]struct{})
+	s.kvDeadOwners = make(map[string]int64)
+	if s.config != nil && s.config.KVStore != nil {
+		s.kvStore = s.config.KVStore
+		s.indexKVStore()
+	} else {
+		s.kvStore = NewMemKVStore()
+	}
+}
+
+// openKVStore 打开存储并为已有数据建立索引
+// 使用Config.KVStore时存储中可能已有数据，需要在读取之前完成
+func (s *SyncMember) openKVStore() {
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	s.lazyInit()
+}
+
+// indexKVStore 为存储中已有的数据建立Merkle树、墓碑、过期和临时键值对索引
+func (s *SyncMember) indexKVStore() {
+	err := s.kvStore.Ascend("", "", func(kv *KV) bool {
+		item := (*kVItem)(kv)
+		s.hlc.update(item.timestamp)
+		s.hlc.update(item.stored)
+		s.indexItem(item)
+		return true
+	})
+	if err != nil {
+		s.logger.Error("index kv store", "error", err)
 	}
 }
 
 type kVItem struct {
 	key   string
 	value []byte
+
+	// 写入时的混合逻辑时钟时间戳和写入节点，用于LWW合并
+	timestamp uint64
+	origin    string
+
+	// 值的类型，CRDT类型的值按各自的规则合并
+	kind kvKind
+
+	// 删除留下的墓碑，阻止错过删除的节点把key重新同步回来
+	deleted bool
+	// 墓碑写入本地时的本地时间戳，用于清理
+	stored uint64
+
+	// 过期时间，Unix毫秒时间戳，0表示不过期
+	expireAt int64
+
+	// 临时键值对所属节点的地址和写入时所属节点的版本
+	// 所属节点死亡留下的墓碑保留owner，incarnation为死亡通知的版本
+	owner       string
+	incarnation int64
+
+	// 删除原因，仅用于通知watcher
+	reason string
 }
 
 func (k *kVItem) Less(than btree.Item) bool {
@@ -28,81 +98,290 @@ func newKVItem(key string, value []byte) *kVItem {
 	}
 }
 
+func (p *KeyValuePayload) item() *kVItem {
+	return &kVItem{
+		key:         p.Key,
+		value:       p.Value,
+		timestamp:   p.Timestamp,
+		origin:      p.Origin,
+		kind:        kvKind(p.Kind),
+		deleted:     p.Deleted,
+		expireAt:    p.ExpireAt,
+		owner:       p.Owner,
+		incarnation: p.Incarnation,
+	}
+}
+
+// keepExpire 更新值不改变过期时间，UpdateKV、CAS和批量写入共用
+// oldItem为nil时是新写入，不设置过期时间
+func (p *KeyValuePayload) keepExpire(oldItem *kVItem) {
+	if oldItem != nil {
+		p.ExpireAt = oldItem.expireAt
+	}
+}
+
+func (k *kVItem) payload() KeyValuePayload {
+	return KeyValuePayload{
+		Key:         k.key,
+		Value:       k.value,
+		Timestamp:   k.timestamp,
+		Origin:      k.origin,
+		Kind:        uint8(k.kind),
+		Deleted:     k.deleted,
+		ExpireAt:    k.expireAt,
+		Owner:       k.owner,
+		Incarnation: k.incarnation,
+	}
+}
+
+// newerThan LWW比较，时间戳相同时依次比较写入节点、rank和值，保证所有节点得到相同的结果
+func (k *kVItem) newerThan(o *kVItem) bool {
+	if k.timestamp != o.timestamp {
+		return k.timestamp > o.timestamp
+	}
+	if k.origin != o.origin {
+		return k.origin > o.origin
+	}
+	if kr, or := k.rank(), o.rank(); kr != or {
+		return kr > or
+	}
+	return bytes.Compare(k.value, o.value) > 0
+}
+
+// rank 同一次写入的不同状态之间的优先级
+// 墓碑优先于写入；所属节点死亡留下的墓碑沿用写入的时间戳，只删除死亡通知版本之前的写入，
+// 所属节点反驳后以不低于死亡通知的版本重新写入，优先于该墓碑
+func (k *kVItem) rank() int64 {
+	switch {
+	case !k.deleted:
+		return 2*k.incarnation + 1
+	case k.owner != "":
+		return 2 * k.incarnation
+	default:
+		return math.MaxInt64
+	}
+}
+
+// getItem 返回key对应的键值对，包括墓碑
+func (s *SyncMember) getItem(key string) *kVItem {
+	kv, err := s.kvStore.Get(key)
+	if err != nil {
+		s.logger.Error("get kv", "key", key, "error", err)
+		return nil
+	}
+	return (*kVItem)(kv)
+}
+
+// getLiveItem 返回key对应的键值对，已删除或已过期时返回nil
+func (s *SyncMember) getLiveItem(key string) *kVItem {
+	item := s.getItem(key)
+	if item == nil || item.deleted || item.expired(s.clock.Now()) {
+		return nil
+	}
+	return item
+}
+
+// tombstone 返回与item版本相同的墓碑
+func (k *kVItem) tombstone() *kVItem {
+	return &kVItem{
+		key:       k.key,
+		timestamp: k.timestamp,
+		origin:    k.origin,
+		kind:      k.kind,
+		deleted:   true,
+	}
+}
+
+// ownerTombstone 所属节点以deadAt版本被判定死亡后留下的墓碑
+func (k *kVItem) ownerTombstone(deadAt int64) *kVItem {
+	t := k.tombstone()
+	t.owner = k.owner
+	t.incarnation = deadAt
+	return t
+}
+
+// kvOperation 本地写入
+// 使用本地混合逻辑时钟为写入打上时间戳后广播
+// 超过maxKVEntryBytes的写入被拒绝
 func (s *SyncMember) kvOperation(op MessageType, kv *KeyValuePayload) {
+	if err := checkKVSize(kv.Key, kv.Value); err != nil {
+		s.logger.Warn("kvOperation", "refused", err)
+		return
+	}
 	s.kvTreeMu.Lock()
 	defer s.kvTreeMu.Unlock()
 	s.lazyInit()
-	item := newKVItem(kv.Key, kv.Value)
-
-	shouldBoardcast := false
-	var oldItem *kVItem
+	s.expireDue()
+	kv.Timestamp = s.hlc.now(s.clock.Now())
+	kv.Origin = s.nodeName
+	item := kv.item()
 
 	switch op {
 	case KVSet:
-		shouldBoardcast = s.setKV(item)
+		if s.getLiveItem(kv.Key) != nil {
+			return
+		}
+		s.putItem(item)
+		s.logger.Info("SetKV", "key", item.key)
+		s.emitKVEvent(EventKVSet, nil, item, "")
 	case KVDelete:
-		shouldBoardcast, oldItem = s.deleteKV(item)
+		oldItem := s.getLiveItem(kv.Key)
+		if oldItem == nil {
+			return
+		}
+		kv.Value = nil
+		kv.Deleted = true
+		s.putItem(kv.item())
+		s.logger.Info("DeleteKV", "key", item.key)
+		s.emitKVEvent(EventKVDelete, oldItem, nil, ReasonDeleted)
 	case KVUpdate:
-		shouldBoardcast, _ = s.updateKV(item)
+		oldItem := s.getLiveItem(kv.Key)
+		//不存在或值相同，不需要更新
+		if oldItem == nil || bytes.Equal(oldItem.value, item.value) {
+			return
+		}
+		if oldItem.kind != kindBytes {
+			s.logger.Warn("UpdateKV", "refused", ErrKVKindMismatch, "key", item.key)
+			return
+		}
+		kv.keepExpire(oldItem)
+		item = kv.item()
+		s.putItem(item)
+		s.logger.Info("UpdateKV", "key", item.key)
+		s.emitKVEvent(EventKVUpdate, oldItem, item, "")
 	default:
 		return
 	}
 
-	if shouldBoardcast {
-		switch op {
-		case KVSet:
-			// 使用协程通知，防止阻塞
-			go s.notifyKVWatcher(EventKVSet, item)
-		case KVDelete:
-			go s.notifyKVWatcher(EventKVDelete, oldItem)
-		case KVUpdate:
-			go s.notifyKVWatcher(EventKVUpdate, item)
-		}
-		//广播
-		s.boardcastQueue.PutMessage(op, kv.Key, kv.Encode().Bytes())
-	}
+	//广播
+	s.boardcastQueue.PutMessage(op, kv.Key, kv.Encode().Bytes())
 }
 
-func (s *SyncMember) setKV(item *kVItem) bool {
-	if exist := s.kvcopyTree.Has(item); exist {
-		return false
+// applyKV 应用通过Gossip收到的写入，改变了本地数据时继续广播
+func (s *SyncMember) applyKV(op MessageType, kv *KeyValuePayload) {
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	s.lazyInit()
+	s.expireDue()
+	if !s.observeKV(kv) {
+		return
 	}
 
-	s.kvcopyTree.ReplaceOrInsert(item)
-	s.logger.Info("SetKV", "key", item.key)
-	return true
+	switch op {
+	case KVSet, KVUpdate:
+	case KVDelete:
+		kv.Value = nil
+		kv.Deleted = true
+	default:
+		return
+	}
+	merged := s.mergeItem(kv.item())
+	if merged == nil {
+		return
+	}
+
+	payload := merged.payload()
+	s.boardcastQueue.PutMessage(op, kv.Key, payload.Encode().Bytes())
 }
 
-func (s *SyncMember) deleteKV(item *kVItem) (bool, *kVItem) {
-	deletedItem := s.kvcopyTree.Delete(item)
-	if deletedItem == nil {
-		return false, nil
+// mergeItem 合并远程写入，返回合并后的键值对，本地数据没有改变时返回nil
+// 双方都是同一种CRDT时合并状态，否则按LWW取较新的一方
+func (s *SyncMember) mergeItem(item *kVItem) *kVItem {
+	reason := ReasonDeleted
+	if !item.deleted && item.expired(s.clock.Now()) {
+		//收到时已过期，按删除处理
+		item = item.tombstone()
+		reason = ReasonExpired
+	}
+	if !item.deleted {
+		if deadAt, dead := s.ownerDead(item); dead {
+			item = item.ownerTombstone(deadAt)
+			reason = ReasonOwnerDead
+		}
 	}
-	s.logger.Info("DeleteKV", "key", item.key)
-	return true, deletedItem.(*kVItem)
+	oldItem := s.getItem(item.key)
+	if oldItem == nil && item.deleted && s.tombstoneCollected(item) {
+		//本地已清理的墓碑，不再从其他节点重新写入
+		return nil
+	}
+	oldLive := oldItem != nil && !oldItem.deleted
+	if oldLive && !item.deleted && item.kind == oldItem.kind && item.kind.isCRDT() {
+		return s.mergeCRDTItem(oldItem, item)
+	}
+	if oldItem != nil && !item.newerThan(oldItem) {
+		return nil
+	}
+	s.putItem(item)
+	switch {
+	case item.deleted:
+		if oldLive {
+			s.logger.Info("DeleteKV", "key", item.key)
+			s.emitKVEvent(EventKVDelete, oldItem, nil, reason)
+		}
+	case !oldLive:
+		s.logger.Info("SetKV", "key", item.key)
+		s.emitKVEvent(EventKVSet, nil, item, "")
+	case !bytes.Equal(oldItem.value, item.value):
+		s.logger.Info("UpdateKV", "key", item.key)
+		s.emitKVEvent(EventKVUpdate, oldItem, item, "")
+	}
+	return item
 }
 
-func (s *SyncMember) updateKV(item *kVItem) (bool, *kVItem) {
-	getItem := s.kvcopyTree.Get(item)
-	if getItem == nil {
-		return false, nil
+// putItem 写入键值对并更新索引，返回被替换的键值对
+// 所有对kvStore的修改都需要经过putItem和removeItem
+func (s *SyncMember) putItem(item *kVItem) *kVItem {
+	if item.deleted && item.stored == 0 {
+		item.stored = s.hlc.now(s.clock.Now())
 	}
-	getBytes := getItem.(*kVItem).value
-	if getBytes == nil {
-		return false, nil
+	old := s.getItem(item.key)
+	if err := s.kvStore.Put((*KV)(item)); err != nil {
+		s.logger.Error("put kv", "key", item.key, "error", err)
+		return nil
 	}
-
-	//如果值相同，不需要更新
-	if bytes.Equal(getBytes, item.value) {
-		return false, nil
+	s.logKV(&kvRecord{Item: item.payload(), Stored: item.stored})
+	if old != nil {
+		s.unindexItem(old)
 	}
+	s.indexItem(item)
+	return old
+}
 
-	old := s.kvcopyTree.ReplaceOrInsert(item)
-	s.logger.Info("UpdateKV", "key", item.key)
+// removeItem 删除键值对并更新索引
+func (s *SyncMember) removeItem(item *kVItem) *kVItem {
+	old := s.getItem(item.key)
 	if old == nil {
-		return false, nil
+		return nil
+	}
+	if err := s.kvStore.Delete(item.key); err != nil {
+		s.logger.Error("delete kv", "key", item.key, "error", err)
+		return nil
+	}
+	s.logKV(&kvRecord{Remove: true, Item: KeyValuePayload{Key: item.key}})
+	s.unindexItem(old)
+	return old
+}
+
+// indexItem 把键值对加入Merkle树、墓碑、过期和临时键值对索引
+func (s *SyncMember) indexItem(item *kVItem) {
+	if item.deleted {
+		s.tombstones[item.key] = item
+	} else {
+		if item.expireAt > 0 {
+			heap.Push(&s.kvExpiry, kvExpiryEntry{key: item.key, expireAt: item.expireAt})
+		}
+		if item.owner != "" {
+			s.indexEphemeral(item)
+		}
 	}
-	return true, old.(*kVItem)
+	s.kvMerkle.add(item)
+}
+
+// unindexItem 从索引中移除键值对，过期索引在到期时跳过已不存在的键值对
+func (s *SyncMember) unindexItem(item *kVItem) {
+	s.unindexEphemeral(item)
+	delete(s.tombstones, item.key)
+	s.kvMerkle.remove(item)
 }
 
 func (s *SyncMember) SetKV(key string, value []byte) {
@@ -129,12 +408,103 @@ func (s *SyncMember) UpdateKV(key string, value []byte) {
 func (s *SyncMember) GetValue(key string) []byte {
 	s.kvTreeMu.RLock()
 	defer s.kvTreeMu.RUnlock()
-	if s.kvcopyTree == nil {
+	if s.kvStore == nil {
 		return nil
 	}
-	res := s.kvcopyTree.Get(newKVItem(key, nil))
+	res := s.getLiveItem(key)
 	if res == nil {
 		return nil
 	}
-	return res.(*kVItem).value
+	return res.value
+}
+
+// mergeKV 合并pushPull收到的键值对
+// 按LWW合并并通知watcher，不再广播，其他节点会通过各自的pushPull获得
+func (s *SyncMember) mergeKV(kvs []KeyValuePayload) {
+	if len(kvs) == 0 {
+		return
+	}
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	s.lazyInit()
+	s.expireDue()
+	for i := range kvs {
+		if !s.observeKV(&kvs[i]) {
+			continue
+		}
+		s.mergeItem(kvs[i].item())
+	}
+}
+
+// observeKV 以远程写入的时间戳推进本地时钟，时间戳超前本地过多时拒绝该写入
+func (s *SyncMember) observeKV(kv *KeyValuePayload) bool {
+	if err := s.hlc.receive(kv.Timestamp, s.clock.Now(), s.config.MaxClockSkew); err != nil {
+		s.logger.Warn("kv refused", "key", kv.Key, "origin", kv.Origin, "error", err)
+		return false
+	}
+	return true
+}
+
+// markKVSynced 记录与节点完成了一次KV同步，start为同步开始时的本地时间戳
+// 此前写入的墓碑都已被该节点收到
+func (s *SyncMember) markKVSynced(addr Address, start uint64) {
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	s.lazyInit()
+	if start > s.kvSyncedAt[addr.String()] {
+		s.kvSyncedAt[addr.String()] = start
+	}
+}
+
+// gcTombstones 清理墓碑
+// 墓碑超过TombstoneGracePeriod，或所有存活节点都在墓碑写入后与本节点同步过时清理
+func (s *SyncMember) gcTombstones() {
+	s.nMutex.Lock()
+	alive := make([]string, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		if n.NodeState() == NodeAlive {
+			alive = append(alive, n.address.String())
+		}
+	}
+	s.nMutex.Unlock()
+
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	if s.kvStore == nil {
+		return
+	}
+	now := s.clock.Now()
+	for _, item := range s.tombstones {
+		if now.Sub(hlcTime(item.stored)) < s.config.TombstoneGracePeriod && !s.seenByAll(item, alive) {
+			continue
+		}
+		s.removeItem(item)
+		s.kvGCHorizon = max(s.kvGCHorizon, item.timestamp)
+		s.logger.Debug("tombstone purged", "key", item.key)
+	}
+}
+
+// tombstoneCollected 本地没有该key时，收到的墓碑是否已经可以清理
+// 不晚于已清理墓碑的写入时间，或已超过TombstoneGracePeriod的墓碑，
+// 其他节点还没来得及清理时会在同步中发回，重新写入会使墓碑永远无法清理
+// 调用者需要持有kvTreeMu
+func (s *SyncMember) tombstoneCollected(item *kVItem) bool {
+	if item.timestamp <= s.kvGCHorizon {
+		return true
+	}
+	return s.clock.Now().Sub(hlcTime(item.timestamp)) >= s.config.TombstoneGracePeriod
+}
+
+// seenByAll 所有存活节点是否都已收到墓碑
+// 没有其他存活节点时无法确认，只能等待TombstoneGracePeriod
+func (s *SyncMember) seenByAll(item *kVItem, alive []string) bool {
+	if len(alive) == 0 {
+		return false
+	}
+	for _, addr := range alive {
+		if s.kvSyncedAt[addr] <= item.stored {
+			return false
+		}
+	}
+	return true
 }
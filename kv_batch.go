@@ -0,0 +1,196 @@
+package syncmember
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrKVBatchTooLarge    = errors.New("kv batch too large")
+	ErrKVBatchUnsupported = errors.New("kv batch unsupported by cluster")
+)
+
+type KVOpType int8
+
+const (
+	// KVOpPut 写入key，不存在时新建，存在时更新
+	KVOpPut KVOpType = iota
+	// KVOpDelete 删除key，不存在时忽略
+	KVOpDelete
+)
+
+// KVOp ApplyBatch中的一个写入
+type KVOp struct {
+	Type  KVOpType
+	Key   string
+	Value []byte
+}
+
+/*
+ApplyBatch 在一次kvTreeMu中完成全部写入，并作为一条消息广播
+
+任意一个写入不合法时返回错误，不写入任何数据
+批量中的每个key都按各自的版本与其他写入LWW合并，
+接收方同样在一次kvTreeMu中合并整个批量，读取者不会看到只合并了一部分的状态
+watcher在整个批量写入后才收到事件
+
+整个批量需要放入一个UDP数据包，超过UDPBufferSize时返回ErrKVBatchTooLarge
+集群中有不支持KVBatch的存活节点时无法保证原子性，返回ErrKVBatchUnsupported，不写入任何数据
+*/
+func (s *SyncMember) ApplyBatch(ops []KVOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	s.nMutex.Lock()
+	batched := s.supports(protocolKVBatch)
+	s.nMutex.Unlock()
+	if !batched {
+		return ErrKVBatchUnsupported
+	}
+
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	s.lazyInit()
+	s.expireDue()
+
+	if err := s.checkKVBatch(ops); err != nil {
+		return err
+	}
+
+	// 先生成全部写入，确认大小后再修改本地数据
+	// 同一个key出现多次时以最后一次为准
+	latest := make(map[string]*kVItem, len(ops))
+	batch := KVBatchPayload{Items: make([]KeyValuePayload, 0, len(ops))}
+	for _, op := range ops {
+		oldItem, ok := latest[op.Key]
+		if !ok {
+			oldItem = s.getLiveItem(op.Key)
+		}
+		kv := KeyValuePayload{
+			Key:       op.Key,
+			Timestamp: s.hlc.now(s.clock.Now()),
+			Origin:    s.nodeName,
+		}
+		switch op.Type {
+		case KVOpPut:
+			if oldItem != nil && bytes.Equal(oldItem.value, op.Value) {
+				continue
+			}
+			kv.Value = op.Value
+			kv.keepExpire(oldItem)
+		case KVOpDelete:
+			if oldItem == nil {
+				continue
+			}
+			kv.Deleted = true
+		}
+		batch.Items = append(batch.Items, kv)
+		latest[op.Key] = kv.item()
+		if kv.Deleted {
+			latest[op.Key] = nil
+		}
+	}
+	if len(batch.Items) == 0 {
+		return nil
+	}
+	payload := batch.Encode().Bytes()
+	if size := len(payload) + compoundOverhead; size > s.config.UDPBufferSize {
+		return fmt.Errorf("%w: %d bytes exceeds udp buffer %d", ErrKVBatchTooLarge, size, s.config.UDPBufferSize)
+	}
+
+	s.mergeKVBatch(&batch)
+	s.boardcastQueue.PutMessage(KVBatch, batch.name(), payload)
+	return nil
+}
+
+// checkKVBatch 检查批量中的每个写入，调用者需要持有kvTreeMu
+func (s *SyncMember) checkKVBatch(ops []KVOp) error {
+	for i, op := range ops {
+		if op.Key == "" {
+			return fmt.Errorf("kv batch op %d: empty key", i)
+		}
+		switch op.Type {
+		case KVOpPut:
+			if item := s.getLiveItem(op.Key); item != nil && item.kind != kindBytes {
+				return fmt.Errorf("kv batch op %d: %w: %q is %s", i, ErrKVKindMismatch, op.Key, item.kind)
+			}
+			if err := checkKVSize(op.Key, op.Value); err != nil {
+				return fmt.Errorf("kv batch op %d: %w", i, err)
+			}
+		case KVOpDelete:
+		default:
+			return fmt.Errorf("kv batch op %d: unknown op type %d", i, op.Type)
+		}
+	}
+	return nil
+}
+
+// name 批量在广播队列中的名称，由第一个写入的版本决定
+func (p *KVBatchPayload) name() string {
+	first := p.Items[0]
+	return fmt.Sprintf("%s@%d", first.Origin, first.Timestamp)
+}
+
+// mergeKVBatch 按顺序合并批量中的全部写入，合并完成后再分发watcher事件
+// 返回本地数据是否改变，调用者需要持有kvTreeMu
+func (s *SyncMember) mergeKVBatch(batch *KVBatchPayload) bool {
+	s.kvBatching = true
+	defer func() {
+		s.kvBatching = false
+		for _, task := range s.kvBatchPending {
+			s.kWatcher.dispatcher.dispatch(task)
+		}
+		s.kvBatchPending = nil
+	}()
+	changed := false
+	for i := range batch.Items {
+		if s.mergeItem(batch.Items[i].item()) != nil {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// applyKVBatch 应用通过Gossip收到的批量写入
+// 批量中有不合法的写入时整体丢弃，改变了本地数据时继续广播
+// 批量写入期间可能有不支持KVBatch的节点加入，此时逐条转发，这些节点无法原子地应用批量
+func (s *SyncMember) applyKVBatch(batch *KVBatchPayload) {
+	if len(batch.Items) == 0 {
+		return
+	}
+	for i := range batch.Items {
+		if batch.Items[i].Key == "" {
+			s.logger.Warn("applyKVBatch", "refused", "empty key", "batch", batch.name())
+			return
+		}
+	}
+	s.nMutex.Lock()
+	batched := s.supports(protocolKVBatch)
+	s.nMutex.Unlock()
+
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	s.lazyInit()
+	s.expireDue()
+	for i := range batch.Items {
+		if !s.observeKV(&batch.Items[i]) {
+			return
+		}
+	}
+	if !s.mergeKVBatch(batch) {
+		return
+	}
+	if !batched {
+		for i := range batch.Items {
+			kv := &batch.Items[i]
+			op := KVSet
+			if kv.Deleted {
+				op = KVDelete
+			}
+			s.boardcastQueue.PutMessage(op, kv.Key, kv.Encode().Bytes())
+		}
+		return
+	}
+	s.boardcastQueue.PutMessage(KVBatch, batch.name(), batch.Encode().Bytes())
+}
@@ -0,0 +1,134 @@
+package syncmember
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gossiped 取出并清空广播队列中的全部消息
+func gossiped(s *SyncMember) []*Message {
+	var messages []*Message
+	seen := make(map[*Message]bool)
+	for {
+		batch := s.boardcastQueue.GetGossipBoardcast(1 << 20)
+		if len(batch) == 0 {
+			return messages
+		}
+		for _, msg := range batch {
+			if !seen[msg] {
+				seen[msg] = true
+				messages = append(messages, msg)
+			}
+		}
+	}
+}
+
+func TestApplyBatch(t *testing.T) {
+	a := newTestMember(t, "127.0.0.1:9101")
+	b := newTestMember(t, "127.0.0.1:9102")
+	a.nodeName, b.nodeName = "a", "b"
+
+	a.SetKV("old", []byte("v"))
+	b.mergeKV(a.leafKVs([]uint32{merkleLeaf("old")}))
+	gossiped(a)
+
+	err := a.ApplyBatch([]KVOp{
+		{Type: KVOpPut, Key: "x", Value: []byte("1")},
+		{Type: KVOpPut, Key: "y", Value: []byte("2")},
+		{Type: KVOpDelete, Key: "old"},
+		{Type: KVOpDelete, Key: "missing"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(a.GetValue("x")))
+	assert.Equal(t, "2", string(a.GetValue("y")))
+	assert.Nil(t, a.GetValue("old"))
+
+	// 整个批量作为一条消息广播
+	messages := gossiped(a)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, KVBatch, messages[0].MsgType)
+
+	// 接收方在整个批量合并后才通知watcher
+	seen := make(chan []byte, 1)
+	b.SetKVWatcher("x", EventKVSet, func(kv *KV) {
+		b.kvTreeMu.RLock()
+		defer b.kvTreeMu.RUnlock()
+		if item := b.getLiveItem("old"); item == nil {
+			seen <- b.getLiveItem("y").value
+		} else {
+			seen <- nil
+		}
+	})
+	b.handleKVBatch(messages[0])
+	select {
+	case v := <-seen:
+		assert.Equal(t, "2", string(v))
+	case <-time.After(time.Second):
+		t.Fatal("watcher not fired")
+	}
+	assert.Equal(t, "1", string(b.GetValue("x")))
+	assert.Nil(t, b.GetValue("old"))
+	assert.Equal(t, a.kvMerkle.levels[0][0], b.kvMerkle.levels[0][0])
+
+	// 已合并的批量不再继续广播
+	gossiped(b)
+	b.handleKVBatch(messages[0])
+	assert.Empty(t, gossiped(b))
+}
+
+func TestApplyBatchRejected(t *testing.T) {
+	s := newTestMember(t, "127.0.0.1:9101")
+	assert.NoError(t, s.Counter("hits").Add(1))
+
+	// 任意一个写入不合法时整体失败
+	err := s.ApplyBatch([]KVOp{
+		{Type: KVOpPut, Key: "x", Value: []byte("1")},
+		{Type: KVOpPut, Key: "hits", Value: []byte("2")},
+	})
+	assert.ErrorIs(t, err, ErrKVKindMismatch)
+	assert.Nil(t, s.GetValue("x"))
+
+	err = s.ApplyBatch([]KVOp{
+		{Type: KVOpPut, Key: "x", Value: []byte("1")},
+		{Type: KVOpPut, Key: "y", Value: make([]byte, s.config.UDPBufferSize)},
+	})
+	assert.ErrorIs(t, err, ErrKVBatchTooLarge)
+	assert.Nil(t, s.GetValue("x"))
+}
+
+func TestApplyBatchUnsupported(t *testing.T) {
+	a := newTestMember(t, "127.0.0.1:9101")
+	b := newTestMember(t, "127.0.0.1:9102")
+	old := newTestMember(t, "127.0.0.1:9103")
+	old.me.protocol = nodeProtocol{min: protocolBase, max: protocolKVSync, cur: protocolKVSync}
+	claim := old.signSelf()
+	a.alive(&claim)
+	gossiped(a)
+
+	// 集群中有不支持KVBatch的节点时不写入任何数据
+	err := a.ApplyBatch([]KVOp{
+		{Type: KVOpPut, Key: "x", Value: []byte("1")},
+		{Type: KVOpPut, Key: "y", Value: []byte("2")},
+	})
+	assert.ErrorIs(t, err, ErrKVBatchUnsupported)
+	assert.Nil(t, a.GetValue("x"))
+	assert.Empty(t, gossiped(a))
+
+	// 收到的批量逐条转发给旧节点
+	assert.NoError(t, b.ApplyBatch([]KVOp{
+		{Type: KVOpPut, Key: "x", Value: []byte("1")},
+		{Type: KVOpDelete, Key: "missing"},
+		{Type: KVOpPut, Key: "y", Value: []byte("2")},
+	}))
+	messages := gossiped(b)
+	assert.Len(t, messages, 1)
+	a.handleKVBatch(messages[0])
+	assert.Equal(t, "1", string(a.GetValue("x")))
+	forwarded := gossiped(a)
+	assert.Len(t, forwarded, 2)
+	for _, msg := range forwarded {
+		assert.Equal(t, KVSet, msg.MsgType)
+	}
+}
@@ -0,0 +1,108 @@
+package syncmember
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrKVNotFound        = errors.New("kv key not found")
+	ErrKVExists          = errors.New("kv key already exists")
+	ErrKVVersionMismatch = errors.New("kv version mismatch")
+)
+
+// 条件写入
+//
+// 版本为写入时的混合逻辑时钟时间戳，每次写入都会得到新的版本。
+// 条件只在本地副本上检查，不同节点上基于同一版本的并发写入都会成功，
+// 它们的版本都大于读到的版本，合并时按LWW取版本较大的一方（版本相同时比较写入节点），
+// 所有节点得到相同的结果，较旧的写入以更新事件的形式被覆盖。
+
+// GetWithVersion 返回key的值和版本，不存在时ok为false
+func (s *SyncMember) GetWithVersion(key string) (value []byte, version uint64, ok bool) {
+	s.kvTreeMu.RLock()
+	defer s.kvTreeMu.RUnlock()
+	if s.kvStore == nil {
+		return nil, 0, false
+	}
+	item := s.getLiveItem(key)
+	if item == nil {
+		return nil, 0, false
+	}
+	return item.value, item.timestamp, true
+}
+
+/*
+CompareAndSwap 只有key当前的版本为expectedVersion时才写入value
+
+return 写入后的新版本
+
+key不存在时返回ErrKVNotFound，版本不同时返回ErrKVVersionMismatch
+*/
+func (s *SyncMember) CompareAndSwap(key string, expectedVersion uint64, value []byte) (uint64, error) {
+	return s.conditionalKV(KVUpdate, key, value, func(oldItem *kVItem) error {
+		if oldItem == nil {
+			return fmt.Errorf("%w: %q", ErrKVNotFound, key)
+		}
+		if oldItem.timestamp != expectedVersion {
+			return fmt.Errorf("%w: %q is at %d, expected %d", ErrKVVersionMismatch, key, oldItem.timestamp, expectedVersion)
+		}
+		if oldItem.kind != kindBytes {
+			return fmt.Errorf("%w: %q is %s", ErrKVKindMismatch, key, oldItem.kind)
+		}
+		return nil
+	})
+}
+
+/*
+PutIfAbsent 只有key不存在时才写入value
+
+return 写入后的版本
+
+key已存在时返回ErrKVExists
+*/
+func (s *SyncMember) PutIfAbsent(key string, value []byte) (uint64, error) {
+	return s.conditionalKV(KVSet, key, value, func(oldItem *kVItem) error {
+		if oldItem != nil {
+			return fmt.Errorf("%w: %q", ErrKVExists, key)
+		}
+		return nil
+	})
+}
+
+// conditionalKV 在kvTreeMu内检查条件后写入并广播
+func (s *SyncMember) conditionalKV(op MessageType, key string, value []byte, check func(oldItem *kVItem) error) (uint64, error) {
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	s.lazyInit()
+	s.expireDue()
+	oldItem := s.getLiveItem(key)
+	if err := check(oldItem); err != nil {
+		return 0, err
+	}
+	if err := checkKVSize(key, value); err != nil {
+		return 0, err
+	}
+
+	kv := &KeyValuePayload{
+		Key:       key,
+		Value:     value,
+		Timestamp: s.hlc.now(s.clock.Now()),
+		Origin:    s.nodeName,
+	}
+	kv.keepExpire(oldItem)
+	item := kv.item()
+	s.putItem(item)
+	if oldItem == nil {
+		s.logger.Info("SetKV", "key", key)
+		s.emitKVEvent(EventKVSet, nil, item, "")
+	} else if !bytes.Equal(oldItem.value, item.value) {
+		//与合并远程写入相同，值不变时只更新版本，不通知
+		s.logger.Info("UpdateKV", "key", key)
+		s.emitKVEvent(EventKVUpdate, oldItem, item, "")
+	}
+
+	s.boardcastQueue.PutMessage(op, key, kv.Encode().Bytes())
+	return item.timestamp, nil
+}
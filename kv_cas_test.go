@@ -0,0 +1,75 @@
+package syncmember
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	s := newTestMember(t, "127.0.0.1:9101")
+
+	v1, err := s.PutIfAbsent("key", []byte("v1"))
+	assert.NoError(t, err)
+	_, err = s.PutIfAbsent("key", []byte("again"))
+	assert.ErrorIs(t, err, ErrKVExists)
+
+	value, version, ok := s.GetWithVersion("key")
+	assert.True(t, ok)
+	assert.Equal(t, "v1", string(value))
+	assert.Equal(t, v1, version)
+
+	v2, err := s.CompareAndSwap("key", v1, []byte("v2"))
+	assert.NoError(t, err)
+	assert.Greater(t, v2, v1)
+	// 使用旧版本写入失败，值不变
+	_, err = s.CompareAndSwap("key", v1, []byte("stale"))
+	assert.ErrorIs(t, err, ErrKVVersionMismatch)
+	assert.Equal(t, "v2", string(s.GetValue("key")))
+
+	_, err = s.CompareAndSwap("missing", v2, []byte("v"))
+	assert.ErrorIs(t, err, ErrKVNotFound)
+
+	assert.NoError(t, s.Counter("hits").Add(1))
+	_, version, _ = s.GetWithVersion("hits")
+	_, err = s.CompareAndSwap("hits", version, []byte("v"))
+	assert.ErrorIs(t, err, ErrKVKindMismatch)
+
+	// 删除后可以再次PutIfAbsent
+	s.DeleteKV("key")
+	_, err = s.PutIfAbsent("key", []byte("v3"))
+	assert.NoError(t, err)
+}
+
+func TestConcurrentCompareAndSwap(t *testing.T) {
+	a := newTestMember(t, "127.0.0.1:9101")
+	b := newTestMember(t, "127.0.0.1:9102")
+	a.nodeName, b.nodeName = "a", "b"
+
+	v1, err := a.PutIfAbsent("key", []byte("v1"))
+	assert.NoError(t, err)
+	exchange(a, b, "key")
+
+	// 两个节点基于同一版本的写入都在本地成功
+	va, err := a.CompareAndSwap("key", v1, []byte("from a"))
+	assert.NoError(t, err)
+	vb, err := b.CompareAndSwap("key", v1, []byte("from b"))
+	assert.NoError(t, err)
+
+	exchange(a, b, "key")
+	want := "from a"
+	if vb > va || (vb == va && b.nodeName > a.nodeName) {
+		want = "from b"
+	}
+	for _, s := range []*SyncMember{a, b} {
+		value, version, _ := s.GetWithVersion("key")
+		assert.Equal(t, want, string(value))
+		assert.Equal(t, max(va, vb), version)
+	}
+
+	// 失败的一方需要基于合并后的版本重试
+	_, err = a.CompareAndSwap("key", min(va, vb), []byte("retry"))
+	if va != vb {
+		assert.ErrorIs(t, err, ErrKVVersionMismatch)
+	}
+}
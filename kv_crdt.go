@@ -0,0 +1,550 @@
+package syncmember
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ciiim/syncmember/codec"
+)
+
+var ErrKVKindMismatch = errors.New("kv value kind mismatch")
+
+// kvKind KV值的类型
+//
+// CRDT类型的值保存完整的状态，Gossip和pushPull时与本地状态合并，
+// 合并满足交换律、结合律和幂等性，并发写入不会丢失。
+// 状态中的集合都按顺序保存，相同的状态编码结果相同，Merkle树摘要才能一致。
+type kvKind uint8
+
+const (
+	kindBytes kvKind = iota
+	kindGCounter
+	kindPNCounter
+	kindORSet
+	kindLWWRegister
+)
+
+func (k kvKind) String() string {
+	switch k {
+	case kindBytes:
+		return "Bytes"
+	case kindGCounter:
+		return "GCounter"
+	case kindPNCounter:
+		return "PNCounter"
+	case kindORSet:
+		return "ORSet"
+	case kindLWWRegister:
+		return "LWWRegister"
+	default:
+		return "Unknown"
+	}
+}
+
+// isCRDT 是否按状态合并，LWWRegister与普通值一样整体按LWW合并
+func (k kvKind) isCRDT() bool {
+	switch k {
+	case kindGCounter, kindPNCounter, kindORSet:
+		return true
+	default:
+		return false
+	}
+}
+
+// gCounterState 只增计数器，每个节点只增加自己的计数，合并时逐节点取最大值
+type gCounterState struct {
+	Counts []counterEntry
+}
+
+type counterEntry struct {
+	Node  string
+	Count uint64
+}
+
+func (g *gCounterState) value() uint64 {
+	var sum uint64
+	for _, e := range g.Counts {
+		sum += e.Count
+	}
+	return sum
+}
+
+func (g *gCounterState) add(node string, n uint64) {
+	i := sort.Search(len(g.Counts), func(i int) bool { return g.Counts[i].Node >= node })
+	if i < len(g.Counts) && g.Counts[i].Node == node {
+		g.Counts[i].Count += n
+		return
+	}
+	g.Counts = append(g.Counts, counterEntry{})
+	copy(g.Counts[i+1:], g.Counts[i:])
+	g.Counts[i] = counterEntry{Node: node, Count: n}
+}
+
+func (g *gCounterState) merge(o *gCounterState) {
+	merged := make([]counterEntry, 0, max(len(g.Counts), len(o.Counts)))
+	i, j := 0, 0
+	for i < len(g.Counts) || j < len(o.Counts) {
+		switch {
+		case j == len(o.Counts) || (i < len(g.Counts) && g.Counts[i].Node < o.Counts[j].Node):
+			merged = append(merged, g.Counts[i])
+			i++
+		case i == len(g.Counts) || o.Counts[j].Node < g.Counts[i].Node:
+			merged = append(merged, o.Counts[j])
+			j++
+		default:
+			merged = append(merged, counterEntry{Node: g.Counts[i].Node, Count: max(g.Counts[i].Count, o.Counts[j].Count)})
+			i++
+			j++
+		}
+	}
+	g.Counts = merged
+}
+
+// pnCounterState 可增可减的计数器，由增加和减少两个只增计数器组成
+type pnCounterState struct {
+	P gCounterState
+	N gCounterState
+}
+
+func (c *pnCounterState) value() int64 {
+	return int64(c.P.value() - c.N.value())
+}
+
+func (c *pnCounterState) add(node string, n int64) {
+	if n >= 0 {
+		c.P.add(node, uint64(n))
+	} else {
+		c.N.add(node, uint64(-n))
+	}
+}
+
+func (c *pnCounterState) merge(o *pnCounterState) {
+	c.P.merge(&o.P)
+	c.N.merge(&o.N)
+}
+
+// orSetState 观察删除集合
+// 每次添加都会为元素生成一个新的dot（副本和序号），删除只去掉元素当前的dot，
+// 因此并发的添加和删除中添加胜出。
+// Context按副本记录已观察到的最大序号，dot不在元素中但被Context覆盖即表示已删除，
+// 不需要保存已删除的标签，状态大小只与存活元素和副本数有关
+type orSetState struct {
+	// 按元素排序
+	Elements []orSetElement
+	// 按副本排序，每个副本一项
+	Context []orSetDot
+}
+
+type orSetElement struct {
+	Elem string
+	// 有序
+	Dots []orSetDot
+}
+
+// orSetDot 副本的一次添加，同一副本的序号严格递增
+type orSetDot struct {
+	Replica string
+	Seq     uint64
+}
+
+func (d orSetDot) less(o orSetDot) bool {
+	if d.Replica != o.Replica {
+		return d.Replica < o.Replica
+	}
+	return d.Seq < o.Seq
+}
+
+func (o *orSetState) find(elem string) (int, bool) {
+	i := sort.Search(len(o.Elements), func(i int) bool { return o.Elements[i].Elem >= elem })
+	return i, i < len(o.Elements) && o.Elements[i].Elem == elem
+}
+
+func (o *orSetState) contains(elem string) bool {
+	_, ok := o.find(elem)
+	return ok
+}
+
+func (o *orSetState) members() []string {
+	members := make([]string, 0, len(o.Elements))
+	for _, e := range o.Elements {
+		members = append(members, e.Elem)
+	}
+	return members
+}
+
+// observed 返回副本已被观察到的最大序号
+func (o *orSetState) observed(replica string) uint64 {
+	i := sort.Search(len(o.Context), func(i int) bool { return o.Context[i].Replica >= replica })
+	if i < len(o.Context) && o.Context[i].Replica == replica {
+		return o.Context[i].Seq
+	}
+	return 0
+}
+
+func (o *orSetState) covers(d orSetDot) bool {
+	return d.Seq <= o.observed(d.Replica)
+}
+
+// add 以replica的新dot添加元素，元素已观察到的dot一并删除
+// seq通常为写入时间戳，不大于已观察到的序号时顺延，保证同一副本的序号严格递增
+func (o *orSetState) add(elem, replica string, seq uint64) {
+	seq = max(seq, o.observed(replica)+1)
+	o.Context = mergeContext(o.Context, []orSetDot{{Replica: replica, Seq: seq}})
+	i, ok := o.find(elem)
+	if !ok {
+		o.Elements = append(o.Elements, orSetElement{})
+		copy(o.Elements[i+1:], o.Elements[i:])
+	}
+	o.Elements[i] = orSetElement{Elem: elem, Dots: []orSetDot{{Replica: replica, Seq: seq}}}
+}
+
+// remove 删除元素，它的dot都已被Context覆盖
+func (o *orSetState) remove(elem string) {
+	i, ok := o.find(elem)
+	if !ok {
+		return
+	}
+	o.Elements = append(o.Elements[:i], o.Elements[i+1:]...)
+}
+
+// merge 双方都有的dot保留；只有一方有的dot，若已被另一方观察到，说明另一方已将其删除
+func (o *orSetState) merge(other *orSetState) {
+	byElem := make(map[string][2][]orSetDot, len(o.Elements)+len(other.Elements))
+	for _, e := range o.Elements {
+		dots := byElem[e.Elem]
+		dots[0] = e.Dots
+		byElem[e.Elem] = dots
+	}
+	for _, e := range other.Elements {
+		dots := byElem[e.Elem]
+		dots[1] = e.Dots
+		byElem[e.Elem] = dots
+	}
+	elements := make([]orSetElement, 0, len(byElem))
+	for elem, dots := range byElem {
+		live := make([]orSetDot, 0, len(dots[0])+len(dots[1]))
+		for _, d := range dots[0] {
+			if containsDot(dots[1], d) || !other.covers(d) {
+				live = append(live, d)
+			}
+		}
+		for _, d := range dots[1] {
+			if !containsDot(dots[0], d) && !o.covers(d) {
+				live = append(live, d)
+			}
+		}
+		if len(live) > 0 {
+			sort.Slice(live, func(i, j int) bool { return live[i].less(live[j]) })
+			elements = append(elements, orSetElement{Elem: elem, Dots: live})
+		}
+	}
+	sort.Slice(elements, func(i, j int) bool { return elements[i].Elem < elements[j].Elem })
+	o.Elements = elements
+	o.Context = mergeContext(o.Context, other.Context)
+}
+
+func containsDot(dots []orSetDot, d orSetDot) bool {
+	i := sort.Search(len(dots), func(i int) bool { return !dots[i].less(d) })
+	return i < len(dots) && dots[i] == d
+}
+
+// mergeContext 逐副本取最大序号
+func mergeContext(a, b []orSetDot) []orSetDot {
+	merged := make([]orSetDot, 0, max(len(a), len(b)))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i].Replica < b[j].Replica):
+			merged = append(merged, a[i])
+			i++
+		case i == len(a) || b[j].Replica < a[i].Replica:
+			merged = append(merged, b[j])
+			j++
+		default:
+			merged = append(merged, orSetDot{Replica: a[i].Replica, Seq: max(a[i].Seq, b[j].Seq)})
+			i++
+			j++
+		}
+	}
+	return merged
+}
+
+// decodeCRDT 解码CRDT状态，value为空时返回零值
+func decodeCRDT[T any](value []byte) (*T, error) {
+	state := new(T)
+	if len(value) == 0 {
+		return state, nil
+	}
+	if err := codec.Unmarshal(value, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// mergeCRDT 合并同一种CRDT的两个状态
+func mergeCRDT(kind kvKind, a, b []byte) ([]byte, error) {
+	switch kind {
+	case kindGCounter:
+		return mergeCRDTState(a, b, (*gCounterState).merge)
+	case kindPNCounter:
+		return mergeCRDTState(a, b, (*pnCounterState).merge)
+	case kindORSet:
+		return mergeCRDTState(a, b, (*orSetState).merge)
+	default:
+		return nil, fmt.Errorf("%s is not a mergeable kind", kind)
+	}
+}
+
+func mergeCRDTState[T any](a, b []byte, merge func(*T, *T)) ([]byte, error) {
+	sa, err := decodeCRDT[T](a)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := decodeCRDT[T](b)
+	if err != nil {
+		return nil, err
+	}
+	merge(sa, sb)
+	return codec.Marshal(sa)
+}
+
+// mergeCRDTItem 合并本地和远程的CRDT状态，时间戳取较新的一方
+func (s *SyncMember) mergeCRDTItem(oldItem, item *kVItem) *kVItem {
+	value, err := mergeCRDT(item.kind, oldItem.value, item.value)
+	if err != nil {
+		s.logger.Error("merge crdt", "key", item.key, "kind", item.kind, "error", err)
+		return nil
+	}
+	if err := checkKVSize(item.key, value); err != nil {
+		//合并后无法同步，保留本地状态，并停止比较这个key的摘要
+		s.logger.Warn("merge crdt", "refused", err, "kind", item.kind)
+		s.kvMerkle.exclude(oldItem)
+		return nil
+	}
+	newer := item
+	if oldItem.newerThan(item) {
+		newer = oldItem
+	}
+	if newer == oldItem && bytes.Equal(value, oldItem.value) {
+		return nil
+	}
+	merged := &kVItem{
+		key:       item.key,
+		value:     value,
+		timestamp: newer.timestamp,
+		origin:    newer.origin,
+		kind:      item.kind,
+	}
+	s.putItem(merged)
+	if !bytes.Equal(value, oldItem.value) {
+		s.logger.Debug("MergeKV", "key", item.key, "kind", item.kind)
+		s.emitKVEvent(EventKVUpdate, oldItem, merged, "")
+	}
+	return merged
+}
+
+// crdtOperation 本地修改CRDT
+// update根据当前状态返回新状态，状态没有变化时不写入也不广播
+func (s *SyncMember) crdtOperation(key string, kind kvKind, update func(value []byte, ts uint64) ([]byte, error)) error {
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	s.lazyInit()
+	s.expireDue()
+	oldItem := s.getLiveItem(key)
+	var oldValue []byte
+	if oldItem != nil {
+		if oldItem.kind != kind {
+			return fmt.Errorf("%w: %q is %s, not %s", ErrKVKindMismatch, key, oldItem.kind, kind)
+		}
+		oldValue = oldItem.value
+	}
+	ts := s.hlc.now(s.clock.Now())
+	value, err := update(oldValue, ts)
+	if err != nil {
+		return err
+	}
+	if err := checkKVSize(key, value); err != nil {
+		return err
+	}
+	if oldItem != nil && bytes.Equal(value, oldValue) {
+		return nil
+	}
+	item := &kVItem{
+		key:       key,
+		value:     value,
+		timestamp: ts,
+		origin:    s.nodeName,
+		kind:      kind,
+	}
+	s.putItem(item)
+
+	op := KVUpdate
+	if oldItem == nil {
+		op = KVSet
+		s.emitKVEvent(EventKVSet, nil, item, "")
+	} else {
+		s.emitKVEvent(EventKVUpdate, oldItem, item, "")
+	}
+	payload := item.payload()
+	s.boardcastQueue.PutMessage(op, key, payload.Encode().Bytes())
+	return nil
+}
+
+// crdtValue 读取CRDT的当前值，key不存在时返回nil
+func (s *SyncMember) crdtValue(key string, kind kvKind) ([]byte, error) {
+	s.kvTreeMu.RLock()
+	defer s.kvTreeMu.RUnlock()
+	if s.kvStore == nil {
+		return nil, nil
+	}
+	item := s.getLiveItem(key)
+	if item == nil {
+		return nil, nil
+	}
+	if item.kind != kind {
+		return nil, fmt.Errorf("%w: %q is %s, not %s", ErrKVKindMismatch, key, item.kind, kind)
+	}
+	return item.value, nil
+}
+
+// updateCRDT 解码状态，修改后重新编码
+func updateCRDT[T any](fn func(state *T, ts uint64)) func(value []byte, ts uint64) ([]byte, error) {
+	return func(value []byte, ts uint64) ([]byte, error) {
+		state, err := decodeCRDT[T](value)
+		if err != nil {
+			return nil, err
+		}
+		fn(state, ts)
+		return codec.Marshal(state)
+	}
+}
+
+func readCRDT[T any](s *SyncMember, key string, kind kvKind) (*T, error) {
+	value, err := s.crdtValue(key, kind)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCRDT[T](value)
+}
+
+// replicaID 本节点在CRDT状态中的标识
+// 节点名称可能重复，使用集群内唯一的广播地址区分副本
+func (s *SyncMember) replicaID() string {
+	return s.me.address.String()
+}
+
+// GCounter 只增计数器
+type GCounter struct {
+	s   *SyncMember
+	key string
+}
+
+// GCounter 返回key对应的只增计数器，key不存在时视为0
+func (s *SyncMember) GCounter(key string) *GCounter {
+	return &GCounter{s: s, key: key}
+}
+
+func (c *GCounter) Add(n uint64) error {
+	return c.s.crdtOperation(c.key, kindGCounter, updateCRDT(func(state *gCounterState, _ uint64) {
+		state.add(c.s.replicaID(), n)
+	}))
+}
+
+func (c *GCounter) Value() (uint64, error) {
+	state, err := readCRDT[gCounterState](c.s, c.key, kindGCounter)
+	if err != nil {
+		return 0, err
+	}
+	return state.value(), nil
+}
+
+// Counter 可增可减的计数器
+type Counter struct {
+	s   *SyncMember
+	key string
+}
+
+// Counter 返回key对应的计数器，key不存在时视为0
+func (s *SyncMember) Counter(key string) *Counter {
+	return &Counter{s: s, key: key}
+}
+
+// Add n可以为负数
+func (c *Counter) Add(n int64) error {
+	return c.s.crdtOperation(c.key, kindPNCounter, updateCRDT(func(state *pnCounterState, _ uint64) {
+		state.add(c.s.replicaID(), n)
+	}))
+}
+
+func (c *Counter) Value() (int64, error) {
+	state, err := readCRDT[pnCounterState](c.s, c.key, kindPNCounter)
+	if err != nil {
+		return 0, err
+	}
+	return state.value(), nil
+}
+
+// Set 观察删除集合，并发的添加和删除中添加胜出
+type Set struct {
+	s   *SyncMember
+	key string
+}
+
+// Set 返回key对应的集合，key不存在时视为空集合
+func (s *SyncMember) Set(key string) *Set {
+	return &Set{s: s, key: key}
+}
+
+func (o *Set) Add(elem string) error {
+	return o.s.crdtOperation(o.key, kindORSet, updateCRDT(func(state *orSetState, ts uint64) {
+		state.add(elem, o.s.replicaID(), ts)
+	}))
+}
+
+func (o *Set) Remove(elem string) error {
+	return o.s.crdtOperation(o.key, kindORSet, updateCRDT(func(state *orSetState, _ uint64) {
+		state.remove(elem)
+	}))
+}
+
+func (o *Set) Contains(elem string) (bool, error) {
+	state, err := readCRDT[orSetState](o.s, o.key, kindORSet)
+	if err != nil {
+		return false, err
+	}
+	return state.contains(elem), nil
+}
+
+// Members 按顺序返回集合中的全部元素
+func (o *Set) Members() ([]string, error) {
+	state, err := readCRDT[orSetState](o.s, o.key, kindORSet)
+	if err != nil {
+		return nil, err
+	}
+	return state.members(), nil
+}
+
+// Register 最后写入胜出的寄存器
+type Register struct {
+	s   *SyncMember
+	key string
+}
+
+// Register 返回key对应的寄存器
+func (s *SyncMember) Register(key string) *Register {
+	return &Register{s: s, key: key}
+}
+
+// Set 写入新值，key不存在时创建
+func (r *Register) Set(value []byte) error {
+	return r.s.crdtOperation(r.key, kindLWWRegister, func([]byte, uint64) ([]byte, error) {
+		return value, nil
+	})
+}
+
+// Get 返回当前值，key不存在时返回nil
+func (r *Register) Get() ([]byte, error) {
+	return r.s.crdtValue(r.key, kindLWWRegister)
+}
@@ -0,0 +1,134 @@
+package syncmember
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// exchange 双向交换key所在叶子的全部数据
+func exchange(a, b *SyncMember, key string) {
+	leaf := []uint32{merkleLeaf(key)}
+	fromA, fromB := a.leafKVs(leaf), b.leafKVs(leaf)
+	a.mergeKV(fromB)
+	b.mergeKV(fromA)
+}
+
+func TestCRDTCounter(t *testing.T) {
+	a := newTestMember(t, "127.0.0.1:9101")
+	b := newTestMember(t, "127.0.0.1:9102")
+	a.nodeName, b.nodeName = "a", "b"
+
+	assert.NoError(t, a.Counter("hits").Add(5))
+	assert.NoError(t, b.Counter("hits").Add(3))
+	assert.NoError(t, b.Counter("hits").Add(-1))
+	assert.NoError(t, a.GCounter("total").Add(2))
+	assert.NoError(t, b.GCounter("total").Add(4))
+
+	exchange(a, b, "hits")
+	exchange(a, b, "total")
+	// 重复合并是幂等的
+	exchange(a, b, "hits")
+
+	for _, s := range []*SyncMember{a, b} {
+		v, err := s.Counter("hits").Value()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(7), v)
+		g, err := s.GCounter("total").Value()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(6), g)
+	}
+	assert.Equal(t, a.kvDigests(0, []uint32{0}), b.kvDigests(0, []uint32{0}))
+
+	_, err := a.GCounter("hits").Value()
+	assert.True(t, errors.Is(err, ErrKVKindMismatch))
+	assert.True(t, errors.Is(a.Set("hits").Add("x"), ErrKVKindMismatch))
+}
+
+func TestCRDTReplicaID(t *testing.T) {
+	a := newTestMember(t, "127.0.0.1:9101")
+	b := newTestMember(t, "127.0.0.1:9102")
+	// 名称相同的节点仍是不同的副本，计数不会互相覆盖
+	a.nodeName, b.nodeName = "same", "same"
+
+	assert.NoError(t, a.GCounter("total").Add(5))
+	assert.NoError(t, b.GCounter("total").Add(3))
+	exchange(a, b, "total")
+
+	for _, s := range []*SyncMember{a, b} {
+		g, err := s.GCounter("total").Value()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(8), g)
+	}
+}
+
+func TestCRDTSet(t *testing.T) {
+	a := newTestMember(t, "127.0.0.1:9101")
+	b := newTestMember(t, "127.0.0.1:9102")
+	a.nodeName, b.nodeName = "a", "b"
+
+	assert.NoError(t, a.Set("s").Add("x"))
+	assert.NoError(t, a.Set("s").Add("y"))
+	exchange(a, b, "s")
+
+	// 并发的删除和添加，添加胜出
+	assert.NoError(t, a.Set("s").Remove("x"))
+	assert.NoError(t, b.Set("s").Add("x"))
+	assert.NoError(t, b.Set("s").Remove("y"))
+	exchange(a, b, "s")
+
+	for _, s := range []*SyncMember{a, b} {
+		members, err := s.Set("s").Members()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"x"}, members)
+	}
+	assert.Equal(t, a.kvDigests(0, []uint32{0}), b.kvDigests(0, []uint32{0}))
+}
+
+// TestCRDTSetCompact 删除不留下标签，反复添加和删除后状态大小不变
+func TestCRDTSetCompact(t *testing.T) {
+	a := newTestMember(t, "127.0.0.1:9101")
+	b := newTestMember(t, "127.0.0.1:9102")
+	c := newTestMember(t, "127.0.0.1:9103")
+
+	for i := 0; i < 2000; i++ {
+		assert.NoError(t, a.Set("s").Add("x"))
+		assert.NoError(t, b.Set("s").Add("y"))
+		exchange(a, b, "s")
+		assert.NoError(t, b.Set("s").Remove("x"))
+		assert.NoError(t, a.Set("s").Remove("y"))
+		exchange(a, b, "s")
+	}
+	assert.Less(t, len(a.GetValue("s")), 256)
+	assert.Equal(t, a.GetValue("s"), b.GetValue("s"))
+
+	// 只持有旧状态的副本不会把已删除的元素同步回来
+	assert.NoError(t, a.Set("s").Add("z"))
+	exchange(a, c, "s")
+	assert.NoError(t, a.Set("s").Remove("z"))
+	exchange(a, b, "s")
+	exchange(b, c, "s")
+	for _, s := range []*SyncMember{a, b, c} {
+		members, err := s.Set("s").Members()
+		assert.NoError(t, err)
+		assert.Empty(t, members)
+	}
+	assert.Equal(t, a.GetValue("s"), c.GetValue("s"))
+}
+
+func TestCRDTRegister(t *testing.T) {
+	a := newTestMember(t, "127.0.0.1:9101")
+	b := newTestMember(t, "127.0.0.1:9102")
+
+	assert.NoError(t, a.Register("r").Set([]byte("a")))
+	assert.NoError(t, b.Register("r").Set([]byte("b")))
+	exchange(a, b, "r")
+
+	va, err := a.Register("r").Get()
+	assert.NoError(t, err)
+	vb, err := b.Register("r").Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(va))
+	assert.Equal(t, va, vb)
+}
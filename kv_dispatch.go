@@ -0,0 +1,100 @@
+package syncmember
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// watcher回调的分发队列
+//
+// key按哈希分配到固定数量的分片，每个分片是一个FIFO队列，同一时刻最多只有一个协程在投递。
+// 事件在kvTreeMu内按写入顺序入队，因此同一个key的回调按写入顺序执行。
+// 入队只追加到队列，不会等待回调，gossip和pushPull不会被慢的watcher阻塞。
+const kvDispatchShards = 16
+
+type kvDispatchTask struct {
+	event *KVEvent
+	kv    *KV
+}
+
+type kvDispatchShard struct {
+	mu      sync.Mutex
+	queue   []kvDispatchTask
+	running bool
+	// 历史最大队列长度
+	maxDepth int
+}
+
+type kvDispatcher struct {
+	shards  [kvDispatchShards]kvDispatchShard
+	deliver func(task kvDispatchTask)
+}
+
+func newKVDispatcher(deliver func(task kvDispatchTask)) *kvDispatcher {
+	return &kvDispatcher{deliver: deliver}
+}
+
+func dispatchShardOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % kvDispatchShards)
+}
+
+// dispatch 入队，分片没有投递协程时启动一个
+func (d *kvDispatcher) dispatch(task kvDispatchTask) {
+	shard := &d.shards[dispatchShardOf(task.event.Key)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.queue = append(shard.queue, task)
+	shard.maxDepth = max(shard.maxDepth, len(shard.queue))
+	if !shard.running {
+		shard.running = true
+		go d.run(shard)
+	}
+}
+
+// run 按顺序投递分片中的事件，队列为空时退出
+func (d *kvDispatcher) run(shard *kvDispatchShard) {
+	for {
+		shard.mu.Lock()
+		if len(shard.queue) == 0 {
+			shard.running = false
+			shard.queue = nil
+			shard.mu.Unlock()
+			return
+		}
+		task := shard.queue[0]
+		shard.queue[0] = kvDispatchTask{}
+		shard.queue = shard.queue[1:]
+		shard.mu.Unlock()
+		d.deliver(task)
+	}
+}
+
+// KVDispatchStats watcher分发队列的状态
+type KVDispatchStats struct {
+	// 每个分片中等待投递的事件数
+	Depths []int
+	// 全部分片中等待投递的事件数
+	Pending int
+	// 单个分片的历史最大队列长度
+	MaxDepth int
+}
+
+func (d *kvDispatcher) stats() KVDispatchStats {
+	stats := KVDispatchStats{Depths: make([]int, kvDispatchShards)}
+	for i := range d.shards {
+		shard := &d.shards[i]
+		shard.mu.Lock()
+		stats.Depths[i] = len(shard.queue)
+		stats.MaxDepth = max(stats.MaxDepth, shard.maxDepth)
+		shard.mu.Unlock()
+		stats.Pending += stats.Depths[i]
+	}
+	return stats
+}
+
+// KVDispatchStats 返回watcher分发队列的状态，队列持续增长说明有watcher处理过慢
+func (s *SyncMember) KVDispatchStats() KVDispatchStats {
+	return s.kWatcher.dispatcher.stats()
+}
@@ -0,0 +1,99 @@
+package syncmember
+
+// SetEphemeralKV 与SetKV相同，键值对属于本节点
+// 本节点被判定死亡或离开集群时，所有节点都会删除这些键值对并以ReasonOwnerDead通知watcher
+func (s *SyncMember) SetEphemeralKV(key string, value []byte) {
+	s.kvOperation(KVSet, &KeyValuePayload{
+		Key:         key,
+		Value:       value,
+		Owner:       s.me.address.String(),
+		Incarnation: s.me.GetInfo().Version,
+	})
+}
+
+// indexEphemeral 调用者需要持有kvTreeMu
+func (s *SyncMember) indexEphemeral(item *kVItem) {
+	keys, ok := s.kvEphemeral[item.owner]
+	if !ok {
+		keys = make(map[string]struct{})
+		s.kvEphemeral[item.owner] = keys
+	}
+	keys[item.key] = struct{}{}
+}
+
+// unindexEphemeral 调用者需要持有kvTreeMu
+func (s *SyncMember) unindexEphemeral(old *kVItem) {
+	if old.owner == "" {
+		return
+	}
+	keys := s.kvEphemeral[old.owner]
+	delete(keys, old.key)
+	if len(keys) == 0 {
+		delete(s.kvEphemeral, old.owner)
+	}
+}
+
+// ephemeralKeys 复制owner的临时键值对的key，遍历期间会修改索引
+func (s *SyncMember) ephemeralKeys(owner string) []string {
+	keys := make([]string, 0, len(s.kvEphemeral[owner]))
+	for key := range s.kvEphemeral[owner] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// ownerDead 临时键值对是否写入于所属节点被判定死亡之前，返回死亡通知的版本
+// 死亡之前写入的键值对按删除处理；所属节点反驳后重新写入的版本不低于死亡通知的版本，
+// 即使本节点尚未收到反驳也正常接受
+func (s *SyncMember) ownerDead(item *kVItem) (int64, bool) {
+	if item.owner == "" {
+		return 0, false
+	}
+	deadAt, ok := s.kvDeadOwners[item.owner]
+	return deadAt, ok && item.incarnation < deadAt
+}
+
+// deleteEphemeralKV 所属节点以version版本被判定死亡，删除它在此之前写入的全部临时键值对
+// 与过期相同，各节点独立删除，墓碑沿用原键值对的时间戳，不需要广播
+func (s *SyncMember) deleteEphemeralKV(owner Address, version int64) {
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	s.lazyInit()
+	addr := owner.String()
+	s.kvDeadOwners[addr] = version
+	for _, key := range s.ephemeralKeys(addr) {
+		item := s.getItem(key)
+		if _, dead := s.ownerDead(item); !dead {
+			continue
+		}
+		s.putItem(item.ownerTombstone(version))
+		s.logger.Info("DeleteKV", "key", key, "reason", ReasonOwnerDead)
+		s.emitKVEvent(EventKVDelete, item, nil, ReasonOwnerDead)
+	}
+}
+
+// reviveEphemeralOwner 所属节点恢复存活，重新接受它的临时键值对
+func (s *SyncMember) reviveEphemeralOwner(owner Address) {
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	if s.kvDeadOwners == nil {
+		return
+	}
+	delete(s.kvDeadOwners, owner.String())
+}
+
+// reassertEphemeralKV 本节点反驳死亡通知后，以新的时间戳和反驳的版本重新写入自己的临时键值对
+func (s *SyncMember) reassertEphemeralKV() {
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	s.lazyInit()
+	for _, key := range s.ephemeralKeys(s.me.address.String()) {
+		item := *s.getItem(key)
+		item.timestamp = s.hlc.now(s.clock.Now())
+		item.origin = s.nodeName
+		item.incarnation = s.me.GetInfo().Version
+		s.putItem(&item)
+		payload := item.payload()
+		s.boardcastQueue.PutMessage(KVSet, key, payload.Encode().Bytes())
+	}
+}
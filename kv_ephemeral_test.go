@@ -0,0 +1,111 @@
+package syncmember
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEphemeralKVOwnerDead(t *testing.T) {
+	owner := newTestMember(t, "127.0.0.1:9101")
+	s := newTestMember(t, "127.0.0.1:9102")
+	owner.SetEphemeralKV("service", []byte("endpoint"))
+	registered := owner.leafKVs([]uint32{merkleLeaf("service")})
+	s.mergeKV(registered)
+	assert.Equal(t, "endpoint", string(s.GetValue("service")))
+
+	deadAt := owner.me.GetInfo().Version + 1
+	s.deleteEphemeralKV(owner.me.address, deadAt)
+	assert.Nil(t, s.GetValue("service"))
+
+	// 死亡前写入的数据延迟到达时不会复活
+	s.applyKV(KVSet, &registered[0])
+	assert.Nil(t, s.GetValue("service"))
+
+	// 所属节点反驳后重新写入
+	s.reviveEphemeralOwner(owner.me.address)
+	s.applyKV(KVSet, &registered[0])
+	assert.Nil(t, s.GetValue("service"))
+	owner.me.increaseVersionTo(deadAt)
+	owner.reassertEphemeralKV()
+	s.mergeKV(owner.leafKVs([]uint32{merkleLeaf("service")}))
+	assert.Equal(t, "endpoint", string(s.GetValue("service")))
+}
+
+// TestEphemeralKVSurviveRefute 所属节点反驳后重新写入的键值对，
+// 在仍认为所属节点死亡的节点上同样保留，墓碑也不能覆盖它们
+func TestEphemeralKVSurviveRefute(t *testing.T) {
+	owner := newTestMember(t, "127.0.0.1:9101")
+	s1 := newTestMember(t, "127.0.0.1:9102")
+	s2 := newTestMember(t, "127.0.0.1:9103")
+	owner.SetEphemeralKV("service", []byte("endpoint"))
+	registered := owner.leafKVs([]uint32{merkleLeaf("service")})
+	s1.mergeKV(registered)
+	s2.mergeKV(registered)
+
+	// 两个节点都判定所属节点死亡
+	deadAt := owner.me.GetInfo().Version + 1
+	s1.deleteEphemeralKV(owner.me.address, deadAt)
+	s2.deleteEphemeralKV(owner.me.address, deadAt)
+	tombstone := s2.leafKVs([]uint32{merkleLeaf("service")})
+	assert.True(t, tombstone[0].Deleted)
+
+	// 所属节点以死亡通知的版本反驳并重新写入
+	owner.me.increaseVersionTo(deadAt)
+	owner.refute()
+	reasserted := owner.leafKVs([]uint32{merkleLeaf("service")})
+	assert.Equal(t, deadAt, reasserted[0].Incarnation)
+
+	// s1收到了反驳，s2仍认为所属节点死亡，两者都保留重新写入的键值对
+	s1.reviveEphemeralOwner(owner.me.address)
+	s1.mergeKV(reasserted)
+	s2.mergeKV(reasserted)
+	assert.Equal(t, "endpoint", string(s1.GetValue("service")))
+	assert.Equal(t, "endpoint", string(s2.GetValue("service")))
+
+	// 死亡之前的墓碑和写入延迟到达时不会覆盖重新写入的键值对
+	owner.mergeKV(tombstone)
+	s2.mergeKV(registered)
+	s2.mergeKV(tombstone)
+	for _, s := range []*SyncMember{owner, s1, s2} {
+		assert.Equal(t, "endpoint", string(s.GetValue("service")))
+	}
+	assert.Equal(t, owner.kvMerkle.levels[0][0], s1.kvMerkle.levels[0][0])
+	assert.Equal(t, owner.kvMerkle.levels[0][0], s2.kvMerkle.levels[0][0])
+}
+
+func TestEphemeralKVOwnerLeft(t *testing.T) {
+	owner := newTestMember(t, "127.0.0.1:9101")
+	s1 := newTestMember(t, "127.0.0.1:9102")
+	s2 := newTestMember(t, "127.0.0.1:9103")
+	claim := owner.me.signedInfo()
+	owner.SetEphemeralKV("service", []byte("endpoint"))
+	registered := owner.leafKVs([]uint32{merkleLeaf("service")})
+	for _, s := range []*SyncMember{s1, s2} {
+		s.alive(&claim)
+		s.mergeKV(registered)
+	}
+
+	// 离开通知由所属节点自己签名，与死亡相同删除临时键值对
+	owner.Leave()
+	left := owner.me.signedInfo()
+	assert.Equal(t, NodeLeft, left.NodeState)
+	s1.handleStateChange(newMessage(Dead, left.Encode().Bytes()), owner.me.Addr())
+	assert.Equal(t, NodeLeft, s1.GetNodeState(owner.me.Addr().String()))
+	assert.Equal(t, left, s1.nodesMap[owner.me.Addr().String()].signedInfo())
+	assert.Nil(t, s1.GetValue("service"))
+
+	// pushPull中转发的离开通知同样生效
+	assert.NoError(t, s2.mergeNodes([]NodeInfoPayload{left}, nil, false))
+	assert.Equal(t, NodeLeft, s2.GetNodeState(owner.me.Addr().String()))
+	assert.Nil(t, s2.GetValue("service"))
+
+	// 离开后的节点不再反驳死亡通知
+	version := owner.me.GetInfo().Version
+	node := s1.nodesMap[owner.me.Addr().String()]
+	node.increaseVersionTo(version + 1)
+	dead := s1.signDead(node)
+	owner.dead(&dead)
+	assert.Equal(t, version, owner.me.GetInfo().Version)
+	assert.Equal(t, NodeLeft, owner.me.NodeState())
+}
@@ -0,0 +1,406 @@
+package syncmember
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+)
+
+// KV数据的Merkle树
+//
+// key按哈希分配到固定数量的叶子中，叶子的摘要为其中所有键值对摘要的异或，
+// 内部节点的摘要为子节点摘要的异或，因此增删一个键值对只需更新根到叶子路径上的摘要。
+// pushPull时双方从根开始逐层比较，只下降到摘要不同的子树，最后只交换不同节点中的键值对。
+//
+// 树中只保存到叶子，键值对较多时叶子之下的层按key哈希的剩余位继续划分，
+// 比较到这些层时从叶子中的键值对临时计算摘要。比较的深度由双方键值对数量的较大值决定，
+// 使最后交换的每个节点只包含少量键值对。
+const (
+	merkleFanout = 16
+	//根节点之下保存的层数
+	merkleDepth = 3
+	//叶子数量 merkleFanout^merkleDepth
+	merkleLeaves = 1 << (4 * merkleDepth)
+	//32位哈希每层使用4位，最多比较到第8层
+	maxMerkleDepth = 8
+	//比较到的每个节点平均包含的键值对数量
+	merkleKeysPerNode = 16
+)
+
+type kvHash [16]byte
+
+func (h *kvHash) xor(o kvHash) {
+	for i := range h {
+		h[i] ^= o[i]
+	}
+}
+
+type kvMerkle struct {
+	// levels[0]为根，levels[merkleDepth]为叶子
+	levels [merkleDepth + 1][]kvHash
+	// 每个叶子包含的key
+	leaves []map[string]struct{}
+	// 合并后超过同步上限的CRDT，不计入摘要
+	excluded map[string]struct{}
+}
+
+func newKVMerkle() *kvMerkle {
+	m := &kvMerkle{
+		leaves:   make([]map[string]struct{}, merkleLeaves),
+		excluded: make(map[string]struct{}),
+	}
+	for d := range m.levels {
+		m.levels[d] = make([]kvHash, 1<<(4*d))
+	}
+	return m
+}
+
+// merkleLeaf 返回key所在的叶子
+func merkleLeaf(key string) uint32 {
+	return merkleIndex(key, merkleDepth)
+}
+
+// merkleIndex 返回key在level层所在的节点
+// 哈希的低位决定叶子，其余位决定叶子之下的节点
+func merkleIndex(key string, level int) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	sum := h.Sum32()
+	path := sum%merkleLeaves<<(32-4*merkleDepth) | sum>>(4*merkleDepth)
+	return path >> (32 - 4*level)
+}
+
+// kvCount 本地键值对的数量，包括墓碑
+func (s *SyncMember) kvCount() int {
+	s.kvTreeMu.RLock()
+	defer s.kvTreeMu.RUnlock()
+	if s.kvStore == nil {
+		return 0
+	}
+	return s.kvStore.Len()
+}
+
+// merkleSyncDepth 按键值对数量决定比较的深度
+func merkleSyncDepth(keys int) int {
+	depth := merkleDepth
+	for depth < maxMerkleDepth && keys > merkleKeysPerNode<<(4*depth) {
+		depth++
+	}
+	return depth
+}
+
+// digest 键值对的摘要
+func (k *kVItem) digest() kvHash {
+	h := sha256.New()
+	h.Write([]byte(k.key))
+	h.Write([]byte{0})
+	h.Write(k.value)
+	h.Write(binary.BigEndian.AppendUint64(nil, k.timestamp))
+	h.Write([]byte(k.origin))
+	h.Write([]byte{byte(k.kind)})
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(k.expireAt)))
+	h.Write([]byte(k.owner))
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(k.incarnation)))
+	if k.deleted {
+		h.Write([]byte{1})
+	}
+	var d kvHash
+	copy(d[:], h.Sum(nil))
+	return d
+}
+
+func (m *kvMerkle) toggle(leaf uint32, d kvHash) {
+	for level := merkleDepth; level >= 0; level-- {
+		m.levels[level][leaf].xor(d)
+		leaf /= merkleFanout
+	}
+}
+
+func (m *kvMerkle) add(item *kVItem) {
+	leaf := merkleLeaf(item.key)
+	if item.deleted || !item.kind.isCRDT() {
+		//删除或被普通值覆盖后，key重新计入摘要
+		delete(m.excluded, item.key)
+	}
+	if _, ok := m.excluded[item.key]; !ok {
+		m.toggle(leaf, item.digest())
+	}
+	if m.leaves[leaf] == nil {
+		m.leaves[leaf] = make(map[string]struct{})
+	}
+	m.leaves[leaf][item.key] = struct{}{}
+}
+
+func (m *kvMerkle) remove(item *kVItem) {
+	leaf := merkleLeaf(item.key)
+	if _, ok := m.excluded[item.key]; !ok {
+		m.toggle(leaf, item.digest())
+	}
+	delete(m.leaves[leaf], item.key)
+}
+
+// exclude 把无法合并的CRDT移出摘要，键值对仍留在叶子中发送给对方
+//
+// 两个状态合并后的大小与合并方向无关，对方收到本地状态时同样无法合并，也会将其移出，
+// 因此双方的摘要可以一致，不会每次pushPull都重新发送同一个叶子。
+// 只记录在内存中，重启后第一次同步时重新发现
+func (m *kvMerkle) exclude(item *kVItem) {
+	if _, ok := m.excluded[item.key]; ok {
+		return
+	}
+	m.toggle(merkleLeaf(item.key), item.digest())
+	m.excluded[item.key] = struct{}{}
+}
+
+// kvDigest Merkle树中一个节点的摘要
+type kvDigest struct {
+	Index uint32
+	Hash  kvHash
+}
+
+// kvDigestChunk 某一层待比较的摘要分片
+type kvDigestChunk struct {
+	Digests []kvDigest
+	More    bool
+}
+
+// kvDiff 响应方回复的摘要不同的节点
+type kvDiff struct {
+	Indexes []uint32
+}
+
+// 单个分片中的摘要数量
+const maxDigestsPerChunk = 512
+
+// merkleChildren 返回下一层中indexes的全部子节点
+func merkleChildren(indexes []uint32) []uint32 {
+	children := make([]uint32, 0, len(indexes)*merkleFanout)
+	for _, i := range indexes {
+		for c := uint32(0); c < merkleFanout; c++ {
+			children = append(children, i*merkleFanout+c)
+		}
+	}
+	return children
+}
+
+// kvDigests 返回level层中indexes的摘要
+func (s *SyncMember) kvDigests(level int, indexes []uint32) []kvDigest {
+	s.kvTreeMu.RLock()
+	defer s.kvTreeMu.RUnlock()
+	digests := make([]kvDigest, 0, len(indexes))
+	if s.kvMerkle == nil {
+		for _, i := range indexes {
+			digests = append(digests, kvDigest{Index: i})
+		}
+		return digests
+	}
+	if level <= merkleDepth {
+		for _, i := range indexes {
+			digests = append(digests, kvDigest{Index: i, Hash: s.kvMerkle.levels[level][i]})
+		}
+		return digests
+	}
+	hashes := make(map[uint32]kvHash, len(indexes))
+	for _, i := range indexes {
+		hashes[i] = kvHash{}
+	}
+	s.ascendMerkleNodes(level, indexes, func(i uint32, item *kVItem) {
+		if _, ok := s.kvMerkle.excluded[item.key]; ok {
+			return
+		}
+		h := hashes[i]
+		h.xor(item.digest())
+		hashes[i] = h
+	})
+	for _, i := range indexes {
+		digests = append(digests, kvDigest{Index: i, Hash: hashes[i]})
+	}
+	return digests
+}
+
+// ascendMerkleNodes 遍历level层中indexes节点内的键值对
+// 叶子之下的节点从所在叶子中筛选，调用者需要持有kvTreeMu
+func (s *SyncMember) ascendMerkleNodes(level int, indexes []uint32, fn func(i uint32, item *kVItem)) {
+	if level < merkleDepth {
+		return
+	}
+	shift := 4 * (level - merkleDepth)
+	wanted := make(map[uint32]struct{}, len(indexes))
+	leaves := make(map[uint32]struct{})
+	for _, i := range indexes {
+		wanted[i] = struct{}{}
+		leaves[i>>shift] = struct{}{}
+	}
+	for leaf := range leaves {
+		for key := range s.kvMerkle.leaves[leaf] {
+			i := merkleIndex(key, level)
+			if _, ok := wanted[i]; !ok {
+				continue
+			}
+			if item := s.getItem(key); item != nil {
+				fn(i, item)
+			}
+		}
+	}
+}
+
+// checkMerkleIndexes 检查对方发来的节点编号是否越界
+func checkMerkleIndexes(level int, indexes []uint32) error {
+	for _, i := range indexes {
+		if uint64(i) >= 1<<(4*level) {
+			return fmt.Errorf("merkle index %d out of range at level %d", i, level)
+		}
+	}
+	return nil
+}
+
+// diffKVDigests 返回与本地摘要不同的节点
+func (s *SyncMember) diffKVDigests(level int, digests []kvDigest) ([]uint32, error) {
+	remote := make([]uint32, 0, len(digests))
+	for _, d := range digests {
+		remote = append(remote, d.Index)
+	}
+	if err := checkMerkleIndexes(level, remote); err != nil {
+		return nil, err
+	}
+	var diff []uint32
+	for i, d := range s.kvDigests(level, remote) {
+		if d.Hash != digests[i].Hash {
+			diff = append(diff, d.Index)
+		}
+	}
+	return diff, nil
+}
+
+// leafKVs 复制叶子中的全部键值对
+func (s *SyncMember) leafKVs(leaves []uint32) []KeyValuePayload {
+	return s.nodeKVs(merkleDepth, leaves)
+}
+
+// nodeKVs 复制level层中indexes节点内的键值对，网络交互期间不持有kvTreeMu
+// 总长度超过maxSyncKVBytes时只复制一部分，其余的在之后的pushPull中同步
+func (s *SyncMember) nodeKVs(level int, indexes []uint32) []KeyValuePayload {
+	s.kvTreeMu.RLock()
+	defer s.kvTreeMu.RUnlock()
+	if s.kvMerkle == nil {
+		return nil
+	}
+	var kvs []KeyValuePayload
+	size := 0
+	s.ascendMerkleNodes(level, indexes, func(_ uint32, item *kVItem) {
+		//写入和合并时已经拒绝过大的键值对，这里不应该出现
+		if err := checkKVSize(item.key, item.value); err != nil {
+			s.logger.Warn("kv entry too large to sync", "error", err)
+			return
+		}
+		payload := item.payload()
+		if size += kvEntrySize(&payload); size > maxSyncKVBytes {
+			return
+		}
+		kvs = append(kvs, payload)
+	})
+	return kvs
+}
+
+func writeKVDigests(conn net.Conn, digests []kvDigest) error {
+	for {
+		n := min(len(digests), maxDigestsPerChunk)
+		chunk := kvDigestChunk{Digests: digests[:n], More: n < len(digests)}
+		if err := writeFrame(conn, &chunk); err != nil {
+			return err
+		}
+		if !chunk.More {
+			return nil
+		}
+		digests = digests[n:]
+	}
+}
+
+// readKVDigests 读取一层的摘要，最多limit个
+func readKVDigests(conn net.Conn, limit int) ([]kvDigest, error) {
+	var digests []kvDigest
+	for {
+		var chunk kvDigestChunk
+		if err := readFrame(conn, &chunk); err != nil {
+			return nil, err
+		}
+		digests = append(digests, chunk.Digests...)
+		if len(digests) > limit {
+			return nil, fmt.Errorf("too many merkle digests %d", len(digests))
+		}
+		if !chunk.More {
+			return digests, nil
+		}
+	}
+}
+
+// syncKV pushPull发起方的KV同步
+// 逐层发送摘要，由响应方回复不同的节点，到达depth层后双方交换不同节点中的键值对
+// 返回响应方的键值对，由调用者合并
+func (s *SyncMember) syncKV(conn net.Conn, depth int) ([]KeyValuePayload, error) {
+	indexes := []uint32{0}
+	for level := 0; ; level++ {
+		//每一轮重新计时，整个同步不受单个超时限制
+		if err := s.extendDeadline(conn); err != nil {
+			return nil, err
+		}
+		if err := writeKVDigests(conn, s.kvDigests(level, indexes)); err != nil {
+			return nil, err
+		}
+		var diff kvDiff
+		if err := readFrame(conn, &diff); err != nil {
+			return nil, err
+		}
+		if err := checkMerkleIndexes(level, diff.Indexes); err != nil {
+			return nil, err
+		}
+		if len(diff.Indexes) == 0 {
+			return nil, nil
+		}
+		if level == depth {
+			if err := writeKVs(conn, s.nodeKVs(level, diff.Indexes)); err != nil {
+				return nil, err
+			}
+			return readKVs(conn)
+		}
+		indexes = merkleChildren(diff.Indexes)
+	}
+}
+
+// handleSyncKV pushPull响应方的KV同步
+func (s *SyncMember) handleSyncKV(conn net.Conn, depth int) error {
+	limit := 1
+	for level := 0; ; level++ {
+		if err := s.extendDeadline(conn); err != nil {
+			return err
+		}
+		digests, err := readKVDigests(conn, limit)
+		if err != nil {
+			return err
+		}
+		diff, err := s.diffKVDigests(level, digests)
+		if err != nil {
+			return err
+		}
+		if err := writeFrame(conn, &kvDiff{Indexes: diff}); err != nil {
+			return err
+		}
+		if len(diff) == 0 {
+			return nil
+		}
+		if level == depth {
+			remote, err := readKVs(conn)
+			if err != nil {
+				return err
+			}
+			// 先复制本地数据，避免把刚收到的数据发回给对方
+			local := s.nodeKVs(level, diff)
+			s.mergeKV(remote)
+			return writeKVs(conn, local)
+		}
+		//下一层只会收到不同节点的子节点
+		limit = len(diff) * merkleFanout
+	}
+}
@@ -0,0 +1,173 @@
+package syncmember
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var allMerkleLeaves = merkleChildren(merkleChildren(merkleChildren([]uint32{0})))
+
+func TestKVMerkleDigest(t *testing.T) {
+	a := newTestMember(t, "127.0.0.1:9101")
+	b := newTestMember(t, "127.0.0.1:9102")
+	for i := 0; i < 1000; i++ {
+		a.SetKV(fmt.Sprintf("key%d", i), []byte("value"))
+	}
+	// 合并顺序不影响摘要
+	kvs := a.leafKVs(allMerkleLeaves)
+	for i := len(kvs) - 1; i >= 0; i-- {
+		b.mergeKV(kvs[i : i+1])
+	}
+	assert.Equal(t, a.kvDigests(0, []uint32{0}), b.kvDigests(0, []uint32{0}))
+
+	b.UpdateKV("key1", []byte("changed"))
+	assert.NotEqual(t, a.kvDigests(0, []uint32{0}), b.kvDigests(0, []uint32{0}))
+	a.mergeKV(b.leafKVs([]uint32{merkleLeaf("key1")}))
+	assert.Equal(t, a.kvDigests(0, []uint32{0}), b.kvDigests(0, []uint32{0}))
+
+	b.DeleteKV("key1")
+	diff, err := a.diffKVDigests(merkleDepth, b.kvDigests(merkleDepth, allMerkleLeaves))
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{merkleLeaf("key1")}, diff)
+}
+
+func TestKVMerkleSync(t *testing.T) {
+	a := newTestMember(t, "127.0.0.1:9101")
+	b := newTestMember(t, "127.0.0.1:9102")
+	for i := 0; i < 20000; i++ {
+		a.SetKV(fmt.Sprintf("key%d", i), []byte("value"))
+	}
+	b.mergeKV(a.leafKVs(allMerkleLeaves))
+
+	sync := func(depth int) []KeyValuePayload {
+		local, remote := net.Pipe()
+		defer local.Close()
+		done := make(chan error, 1)
+		go func() {
+			done <- b.handleSyncKV(remote, depth)
+		}()
+		received, err := a.syncKV(local, depth)
+		assert.NoError(t, err)
+		assert.NoError(t, <-done)
+		a.mergeKV(received)
+		return received
+	}
+
+	// 只传输不同叶子中的键值对
+	a.SetKV("onlyA", []byte("a"))
+	b.SetKV("onlyB", []byte("b"))
+	assert.Less(t, len(sync(merkleDepth)), 100)
+	assert.Equal(t, "b", string(a.GetValue("onlyB")))
+	assert.Equal(t, "a", string(b.GetValue("onlyA")))
+	assert.Equal(t, a.kvDigests(0, []uint32{0}), b.kvDigests(0, []uint32{0}))
+
+	// 比较到叶子之下时只传输不同的键值对
+	a.SetKV("onlyA2", []byte("a"))
+	b.SetKV("onlyB2", []byte("b"))
+	received := sync(maxMerkleDepth)
+	assert.Len(t, received, 1)
+	assert.Equal(t, "b", string(a.GetValue("onlyB2")))
+	assert.Equal(t, "a", string(b.GetValue("onlyA2")))
+	assert.Equal(t, a.kvDigests(0, []uint32{0}), b.kvDigests(0, []uint32{0}))
+}
+
+func TestMerkleSyncDepth(t *testing.T) {
+	assert.Equal(t, merkleDepth, merkleSyncDepth(0))
+	assert.Equal(t, merkleDepth, merkleSyncDepth(merkleKeysPerNode*merkleLeaves))
+	assert.Equal(t, merkleDepth+1, merkleSyncDepth(merkleKeysPerNode*merkleLeaves+1))
+	assert.Equal(t, merkleDepth+1, merkleSyncDepth(500000))
+	assert.Equal(t, maxMerkleDepth, merkleSyncDepth(math.MaxInt))
+
+	// 叶子之下的节点与叶子的摘要一致
+	s := newTestMember(t, "127.0.0.1:9101")
+	for i := 0; i < 2000; i++ {
+		s.SetKV(fmt.Sprintf("key%d", i), []byte("value"))
+	}
+	leaf := merkleLeaf("key0")
+	children := merkleChildren([]uint32{leaf})
+	var sum kvHash
+	for _, d := range s.kvDigests(merkleDepth+1, children) {
+		sum.xor(d.Hash)
+	}
+	assert.Equal(t, s.kvDigests(merkleDepth, []uint32{leaf})[0].Hash, sum)
+	assert.Equal(t, leaf, merkleIndex("key0", merkleDepth+1)/merkleFanout)
+	assert.NoError(t, checkMerkleIndexes(maxMerkleDepth, []uint32{math.MaxUint32}))
+	assert.Error(t, checkMerkleIndexes(merkleDepth, []uint32{merkleLeaves}))
+}
+
+func TestReadKVsLimit(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		defer remote.Close()
+		entry := KeyValuePayload{Key: "key", Value: make([]byte, maxKVEntryBytes/2)}
+		for {
+			if err := writeFrame(remote, &kvChunk{Entries: []KeyValuePayload{entry}, More: true}); err != nil {
+				return
+			}
+		}
+	}()
+	_, err := readKVs(local)
+	assert.ErrorContains(t, err, "exceeds")
+}
+
+func TestKVTooLarge(t *testing.T) {
+	s := newTestMember(t, "127.0.0.1:9101")
+	large := make([]byte, maxKVEntryBytes)
+
+	// 无法通过pushPull同步的键值对在写入时被拒绝
+	s.SetKV("key", large)
+	assert.Nil(t, s.GetValue("key"))
+	_, err := s.PutIfAbsent("key", large)
+	assert.ErrorIs(t, err, ErrKVTooLarge)
+	err = s.ApplyBatch([]KVOp{{Type: KVOpPut, Key: "key", Value: large}})
+	assert.ErrorIs(t, err, ErrKVTooLarge)
+
+	s.SetKV("key", []byte("v"))
+	s.UpdateKV("key", large)
+	assert.Equal(t, "v", string(s.GetValue("key")))
+	assert.Len(t, s.leafKVs([]uint32{merkleLeaf("key")}), 1)
+}
+
+func TestCRDTMergeTooLarge(t *testing.T) {
+	a := newTestMember(t, "127.0.0.1:9101")
+	b := newTestMember(t, "127.0.0.1:9102")
+	c := newTestMember(t, "127.0.0.1:9103")
+
+	// 各自都能同步，合并后超过上限
+	elem := strings.Repeat("x", 1000)
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, a.Set("big").Add(fmt.Sprintf("a%d%s", i, elem)))
+		assert.NoError(t, b.Set("big").Add(fmt.Sprintf("b%d%s", i, elem)))
+	}
+	a.SetKV("other", []byte("v"))
+	exchange(a, b, "other")
+	exchange(a, c, "other")
+
+	// 无法合并时保留本地状态，双方都不再比较这个key
+	exchange(a, b, "big")
+	members, err := a.Set("big").Members()
+	assert.NoError(t, err)
+	assert.Len(t, members, 20)
+	assert.Len(t, a.leafKVs([]uint32{merkleLeaf("big")}), 1)
+	assert.Equal(t, a.kvDigests(0, []uint32{0}), b.kvDigests(0, []uint32{0}))
+
+	// 只见过一方状态的节点，在遇到另一方后同样停止比较
+	exchange(a, c, "big")
+	assert.NotEqual(t, a.kvDigests(0, []uint32{0}), c.kvDigests(0, []uint32{0}))
+	exchange(b, c, "big")
+	assert.Equal(t, a.kvDigests(0, []uint32{0}), c.kvDigests(0, []uint32{0}))
+
+	// 删除后重新计入摘要
+	a.DeleteKV("big")
+	exchange(a, b, "big")
+	exchange(a, c, "big")
+	assert.Nil(t, b.GetValue("big"))
+	assert.Equal(t, a.kvDigests(0, []uint32{0}), b.kvDigests(0, []uint32{0}))
+	assert.Equal(t, a.kvDigests(0, []uint32{0}), c.kvDigests(0, []uint32{0}))
+}
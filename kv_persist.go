@@ -0,0 +1,281 @@
+package syncmember
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ciiim/syncmember/codec"
+)
+
+// KV数据持久化
+//
+// 设置Config.DataDir后，对kvStore的每次修改（本地写入、远程合并、过期、墓碑清理）
+// 都会追加到预写日志中，并定期把整棵树写入快照后截断日志。
+// NewSyncMember时先加载快照再重放日志，之后才开始收发数据包。
+//
+// 日志写入操作系统后即返回，不对每条记录fsync，进程崩溃不会丢失数据，
+// 机器掉电可能丢失最后一次快照之后的部分写入，重启后由pushPull从其他节点补齐。
+//
+// 快照时先在kvTreeMu内复制全部键值对并把日志改名为kv.wal.old，之后的写入进入新日志，
+// 快照写完后删除kv.wal.old。加载时依次应用快照、kv.wal.old和kv.wal，
+// kv.wal.old中的记录重放完毕后与快照的状态相同，因此在任意一步崩溃都能恢复。
+const (
+	kvSnapshotFile = "kv.snapshot"
+	kvWALFile      = "kv.wal"
+	kvOldWALFile   = "kv.wal.old"
+)
+
+// kvRecord 日志和快照中的一条记录
+type kvRecord struct {
+	//为true时删除Item.Key，否则写入Item
+	Remove bool
+	Item   KeyValuePayload
+	//墓碑写入本地的时间戳
+	Stored uint64
+}
+
+// 记录头：长度和CRC32
+const kvRecordHeader = 8
+
+func writeKVRecord(w io.Writer, rec *kvRecord) error {
+	body, err := codec.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, kvRecordHeader, kvRecordHeader+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(body))
+	_, err = w.Write(append(buf, body...))
+	return err
+}
+
+// readKVRecords 按顺序读取文件中的记录，返回最后一条完整记录之后的偏移
+func readKVRecords(path string, fn func(rec *kvRecord)) (int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return scanKVRecords(f, func(rec *kvRecord, _ int64) {
+		fn(rec)
+	}), nil
+}
+
+// scanKVRecords 按顺序读取记录，size为记录包括头部的长度，返回最后一条完整记录之后的偏移
+// 末尾不完整或校验失败的记录视为崩溃时未写完，忽略其后的内容
+func scanKVRecords(r io.Reader, fn func(rec *kvRecord, size int64)) int64 {
+	br := bufio.NewReader(r)
+	var offset int64
+	header := make([]byte, kvRecordHeader)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return offset
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(br, body); err != nil {
+			return offset
+		}
+		rec, err := decodeKVRecord(header, body)
+		if err != nil {
+			return offset
+		}
+		size := int64(kvRecordHeader + len(body))
+		fn(rec, size)
+		offset += size
+	}
+}
+
+func decodeKVRecord(header, body []byte) (*kvRecord, error) {
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("kv record checksum mismatch")
+	}
+	var rec kvRecord
+	if err := codec.Unmarshal(body, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// loadKVData 加载快照和日志并打开日志，需要在收发数据包之前调用
+func (s *SyncMember) loadKVData() error {
+	dir := s.config.DataDir
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	s.lazyInit()
+
+	replay := func(rec *kvRecord) {
+		s.hlc.update(rec.Item.Timestamp)
+		s.hlc.update(rec.Stored)
+		if rec.Remove {
+			s.removeItem(newKVItem(rec.Item.Key, nil))
+			return
+		}
+		item := rec.Item.item()
+		item.stored = rec.Stored
+		s.putItem(item)
+	}
+	for _, name := range []string{kvSnapshotFile, kvOldWALFile} {
+		if _, err := readKVRecords(filepath.Join(dir, name), replay); err != nil {
+			return fmt.Errorf("load %s: %w", name, err)
+		}
+	}
+	walPath := filepath.Join(dir, kvWALFile)
+	end, err := readKVRecords(walPath, replay)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", kvWALFile, err)
+	}
+
+	wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	// 丢弃末尾未写完的记录
+	if err := wal.Truncate(end); err != nil {
+		wal.Close()
+		return err
+	}
+	if _, err := wal.Seek(end, io.SeekStart); err != nil {
+		wal.Close()
+		return err
+	}
+	s.kvWAL = wal
+	s.logger.Info("kv data loaded", "dir", dir, "keys", s.kvStore.Len())
+	return nil
+}
+
+// logKV 追加一条日志，调用者需要持有kvTreeMu
+func (s *SyncMember) logKV(rec *kvRecord) {
+	if s.kvWAL == nil {
+		return
+	}
+	if err := writeKVRecord(s.kvWAL, rec); err != nil {
+		s.logger.Error("write kv wal", "key", rec.Item.Key, "error", err)
+	}
+}
+
+func (s *SyncMember) snapshot() {
+	for {
+		select {
+		case <-s.snapshotTicker.C():
+			if err := s.snapshotKV(); err != nil {
+				s.logger.Error("kv snapshot", "error", err)
+			}
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// snapshotKV 把全部键值对写入快照并截断日志
+func (s *SyncMember) snapshotKV() error {
+	dir := s.config.DataDir
+	oldPath := filepath.Join(dir, kvOldWALFile)
+
+	s.kvTreeMu.Lock()
+	if s.kvWAL == nil {
+		s.kvTreeMu.Unlock()
+		return nil
+	}
+	snapshot, err := s.kvStore.Snapshot()
+	if err != nil {
+		s.kvTreeMu.Unlock()
+		return err
+	}
+	defer snapshot.Release()
+	if _, statErr := os.Stat(oldPath); statErr != nil {
+		err = s.rotateKVWAL()
+	}
+	// 否则上一次快照没有完成，kv.wal.old还在，不能覆盖
+	// 此时不切换日志，当前日志中的记录重放后仍得到最新状态
+	s.kvTreeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.writeKVSnapshot(snapshot)
+}
+
+// rotateKVWAL 把当前日志改名为kv.wal.old并打开新日志，调用者需要持有kvTreeMu
+func (s *SyncMember) rotateKVWAL() error {
+	dir := s.config.DataDir
+	walPath := filepath.Join(dir, kvWALFile)
+	if err := s.kvWAL.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(walPath, filepath.Join(dir, kvOldWALFile)); err != nil {
+		return err
+	}
+	wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	s.kvWAL.Close()
+	s.kvWAL = wal
+	return nil
+}
+
+// writeKVSnapshot 写入快照后删除kv.wal.old
+func (s *SyncMember) writeKVSnapshot(snapshot KVStoreSnapshot) error {
+	dir := s.config.DataDir
+	tmpPath := filepath.Join(dir, kvSnapshotFile+".tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = snapshot.Ascend("", "", func(kv *KV) bool {
+		item := (*kVItem)(kv)
+		err = writeKVRecord(w, &kvRecord{Item: item.payload(), Stored: item.stored})
+		return err == nil
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, kvSnapshotFile)); err != nil {
+		return err
+	}
+	s.logger.Debug("kv snapshot written", "keys", snapshot.Len())
+	return os.Remove(filepath.Join(dir, kvOldWALFile))
+}
+
+// closeKVData 同步并关闭日志和存储
+func (s *SyncMember) closeKVData() {
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	if s.kvStore != nil {
+		if err := s.kvStore.Close(); err != nil {
+			s.logger.Error("close kv store", "error", err)
+		}
+	}
+	if s.kvWAL == nil {
+		return
+	}
+	if err := s.kvWAL.Sync(); err != nil {
+		s.logger.Error("sync kv wal", "error", err)
+	}
+	s.kvWAL.Close()
+	s.kvWAL = nil
+}
@@ -0,0 +1,128 @@
+package syncmember
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ciiim/syncmember/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPersistentMember(t *testing.T, dir string) *SyncMember {
+	t.Helper()
+	s := newTestMember(t, "127.0.0.1:9101")
+	s.config.DataDir = dir
+	if err := s.loadKVData(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestKVPersistence(t *testing.T) {
+	dir := t.TempDir()
+	s := newPersistentMember(t, dir)
+
+	s.SetKV("a", []byte("1"))
+	s.SetKV("b", []byte("2"))
+	assert.NoError(t, s.snapshotKV())
+
+	// 快照之后的本地写入和远程写入
+	s.UpdateKV("a", []byte("10"))
+	s.DeleteKV("b")
+	s.applyKV(KVSet, &KeyValuePayload{Key: "remote", Value: []byte("r"), Timestamp: s.hlc.now(s.clock.Now()), Origin: "other"})
+	_, err := os.Stat(filepath.Join(dir, kvOldWALFile))
+	assert.True(t, os.IsNotExist(err))
+	s.closeKVData()
+
+	// 模拟崩溃时写了一半的记录
+	wal, err := os.OpenFile(filepath.Join(dir, kvWALFile), os.O_APPEND|os.O_WRONLY, 0o644)
+	assert.NoError(t, err)
+	_, err = wal.Write([]byte{0, 0, 1, 0, 1, 2})
+	assert.NoError(t, err)
+	wal.Close()
+
+	restored := newPersistentMember(t, dir)
+	defer restored.closeKVData()
+	assert.Equal(t, "10", string(restored.GetValue("a")))
+	assert.Nil(t, restored.GetValue("b"))
+	assert.Equal(t, "r", string(restored.GetValue("remote")))
+	// 墓碑和版本都被恢复，与重启前的数据一致
+	assert.Contains(t, restored.tombstones, "b")
+	assert.Equal(t, s.kvMerkle.levels[0][0], restored.kvMerkle.levels[0][0])
+	// 之后的本地写入晚于恢复的写入
+	_, version, _ := restored.GetWithVersion("a")
+	restored.UpdateKV("a", []byte("11"))
+	_, next, _ := restored.GetWithVersion("a")
+	assert.Greater(t, next, version)
+
+	// 截断的记录被丢弃，之后的写入可以正常恢复
+	restored.closeKVData()
+	again := newPersistentMember(t, dir)
+	defer again.closeKVData()
+	assert.Equal(t, "11", string(again.GetValue("a")))
+}
+
+func TestKVPersistenceIncompleteSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	s := newPersistentMember(t, dir)
+	s.SetKV("a", []byte("1"))
+
+	// 切换日志后、写入快照前崩溃
+	s.kvTreeMu.Lock()
+	assert.NoError(t, s.rotateKVWAL())
+	s.kvTreeMu.Unlock()
+	s.SetKV("b", []byte("2"))
+	s.closeKVData()
+
+	restored := newPersistentMember(t, dir)
+	assert.Equal(t, "1", string(restored.GetValue("a")))
+	assert.Equal(t, "2", string(restored.GetValue("b")))
+
+	// 下一次快照不覆盖旧日志，完成后删除旧日志
+	restored.SetKV("c", []byte("3"))
+	assert.NoError(t, restored.snapshotKV())
+	_, err := os.Stat(filepath.Join(dir, kvOldWALFile))
+	assert.True(t, os.IsNotExist(err))
+	restored.closeKVData()
+
+	again := newPersistentMember(t, dir)
+	defer again.closeKVData()
+	for key, value := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		assert.Equal(t, value, string(again.GetValue(key)))
+	}
+}
+
+// failingTransport 启动失败的Transport
+type failingTransport struct {
+	transport.Transport
+}
+
+func (failingTransport) Start(func(*transport.Packet), func(net.Conn)) error {
+	return errors.New("address in use")
+}
+
+// closeRecorder 记录Close调用的存储
+type closeRecorder struct {
+	KVStore
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return c.KVStore.Close()
+}
+
+func TestKVDataClosedOnStartFailure(t *testing.T) {
+	store := &closeRecorder{KVStore: NewMemKVStore()}
+	s := NewSyncMember("node", DefaultConfig().
+		SetTransport(failingTransport{}).
+		SetDataDir(t.TempDir()).
+		SetKVStore(store).
+		SetLogLevel(slog.LevelError))
+	assert.Nil(t, s)
+	assert.True(t, store.closed)
+}
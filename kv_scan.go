@@ -0,0 +1,95 @@
+package syncmember
+
+import "strings"
+
+// KVPair 扫描返回的键值对副本
+type KVPair struct {
+	Key   string
+	Value []byte
+}
+
+// ascendLive 从start开始按顺序遍历未删除、未过期的键值对，fn返回false时停止
+// 调用者需要持有kvTreeMu
+func (s *SyncMember) ascendLive(start string, fn func(item *kVItem) bool) {
+	if s.kvStore == nil {
+		return
+	}
+	now := s.clock.Now()
+	err := s.kvStore.Ascend(start, "", func(kv *KV) bool {
+		item := (*kVItem)(kv)
+		if item.deleted || item.expired(now) {
+			return true
+		}
+		return fn(item)
+	})
+	if err != nil {
+		s.logger.Error("scan kv", "start", start, "error", err)
+	}
+}
+
+func (k *kVItem) pair() KVPair {
+	value := make([]byte, len(k.value))
+	copy(value, k.value)
+	return KVPair{Key: k.key, Value: value}
+}
+
+// ListKV 按顺序返回以prefix开头的全部键值对
+func (s *SyncMember) ListKV(prefix string) []KVPair {
+	s.kvTreeMu.RLock()
+	defer s.kvTreeMu.RUnlock()
+	var pairs []KVPair
+	s.ascendLive(prefix, func(item *kVItem) bool {
+		if !strings.HasPrefix(item.key, prefix) {
+			return false
+		}
+		pairs = append(pairs, item.pair())
+		return true
+	})
+	return pairs
+}
+
+// RangeKV 按顺序返回[start, end)内的键值对
+// end为空时没有上界，limit不大于0时不限制数量
+func (s *SyncMember) RangeKV(start, end string, limit int) []KVPair {
+	s.kvTreeMu.RLock()
+	defer s.kvTreeMu.RUnlock()
+	var pairs []KVPair
+	s.ascendLive(start, func(item *kVItem) bool {
+		if end != "" && item.key >= end {
+			return false
+		}
+		pairs = append(pairs, item.pair())
+		return limit <= 0 || len(pairs) < limit
+	})
+	return pairs
+}
+
+// ListKeys 分页返回以prefix开头的key
+//
+// cursor为上一页返回的next，第一页传空字符串；
+// next为空表示已经没有更多的key
+func (s *SyncMember) ListKeys(prefix, cursor string, limit int) (keys []string, next string) {
+	s.kvTreeMu.RLock()
+	defer s.kvTreeMu.RUnlock()
+	start := prefix
+	if cursor != "" {
+		// cursor之后的第一个key
+		start = cursor + "\x00"
+	}
+	more := false
+	s.ascendLive(start, func(item *kVItem) bool {
+		if !strings.HasPrefix(item.key, prefix) {
+			return false
+		}
+		if limit > 0 && len(keys) == limit {
+			more = true
+			return false
+		}
+		keys = append(keys, item.key)
+		return true
+	})
+	if more {
+		next = keys[len(keys)-1]
+	}
+	return keys, next
+}
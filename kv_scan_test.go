@@ -0,0 +1,54 @@
+package syncmember
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKVScan(t *testing.T) {
+	s := newTestMember(t, "127.0.0.1:9101")
+	for _, svc := range []string{"api", "db", "web"} {
+		for i := 0; i < 3; i++ {
+			s.SetKV(fmt.Sprintf("services/%s/node%d", svc, i), []byte(svc))
+		}
+	}
+	s.SetKV("servicesX", []byte("other"))
+	s.DeleteKV("services/db/node1")
+
+	pairs := s.ListKV("services/db/")
+	assert.Len(t, pairs, 2)
+	assert.Equal(t, "services/db/node0", pairs[0].Key)
+	assert.Equal(t, "services/db/node2", pairs[1].Key)
+
+	// 返回的是副本
+	pairs[0].Value[0] = 'x'
+	assert.Equal(t, "db", string(s.GetValue("services/db/node0")))
+
+	pairs = s.RangeKV("services/api/node1", "services/db/node2", 0)
+	assert.Equal(t, []string{"services/api/node1", "services/api/node2", "services/db/node0"}, pairKeys(pairs))
+	pairs = s.RangeKV("services/", "", 2)
+	assert.Equal(t, []string{"services/api/node0", "services/api/node1"}, pairKeys(pairs))
+
+	var all []string
+	cursor := ""
+	for {
+		keys, next := s.ListKeys("services/", cursor, 3)
+		all = append(all, keys...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Len(t, all, 8)
+	assert.Equal(t, "services/web/node2", all[len(all)-1])
+}
+
+func pairKeys(pairs []KVPair) []string {
+	keys := make([]string, 0, len(pairs))
+	for _, p := range pairs {
+		keys = append(keys, p.Key)
+	}
+	return keys
+}
@@ -0,0 +1,110 @@
+package syncmember
+
+import (
+	"github.com/ciiim/syncmember/codec"
+	"github.com/google/btree"
+)
+
+// KVReader 按key有序的只读键值对集合
+type KVReader interface {
+	// Get 返回key对应的键值对，包括墓碑，不存在时返回nil
+	Get(key string) (*KV, error)
+	// Ascend 按key的顺序遍历[start, end)内的键值对，end为空时没有上界，fn返回false时停止
+	Ascend(start, end string, fn func(kv *KV) bool) error
+	Len() int
+}
+
+/*
+KVStore 保存KV数据的存储
+
+SyncMember在kvTreeMu内调用写入方法，读取方法可能被并发调用
+Put之后SyncMember不会再修改传入的键值对，存储可以直接保存该指针
+*/
+type KVStore interface {
+	KVReader
+	// Put 写入键值对，已存在时替换
+	Put(kv *KV) error
+	// Delete 删除key，不存在时忽略
+	Delete(key string) error
+	// Snapshot 返回当前数据的只读快照，之后的写入不影响快照，用完后需要Release
+	Snapshot() (KVStoreSnapshot, error)
+	// Close 在SyncMember关闭时调用
+	Close() error
+}
+
+type KVStoreSnapshot interface {
+	KVReader
+	Release()
+}
+
+// MarshalBinary 编码键值对，用于实现保存到磁盘的KVStore
+func (kv *KV) MarshalBinary() ([]byte, error) {
+	item := (*kVItem)(kv)
+	return codec.Marshal(&kvRecord{Item: item.payload(), Stored: item.stored})
+}
+
+// UnmarshalBinary 解码MarshalBinary的结果
+func (kv *KV) UnmarshalBinary(b []byte) error {
+	var rec kvRecord
+	if err := codec.Unmarshal(b, &rec); err != nil {
+		return err
+	}
+	item := rec.Item.item()
+	item.stored = rec.Stored
+	*kv = KV(*item)
+	return nil
+}
+
+// memKVStore 内存中的B树，默认的KVStore
+type memKVStore struct {
+	tree *btree.BTree
+}
+
+func NewMemKVStore() KVStore {
+	return &memKVStore{tree: btree.New(32)}
+}
+
+func (m *memKVStore) Get(key string) (*KV, error) {
+	item := m.tree.Get(newKVItem(key, nil))
+	if item == nil {
+		return nil, nil
+	}
+	return (*KV)(item.(*kVItem)), nil
+}
+
+func (m *memKVStore) Ascend(start, end string, fn func(kv *KV) bool) error {
+	iterator := func(i btree.Item) bool {
+		return fn((*KV)(i.(*kVItem)))
+	}
+	if end == "" {
+		m.tree.AscendGreaterOrEqual(newKVItem(start, nil), iterator)
+	} else {
+		m.tree.AscendRange(newKVItem(start, nil), newKVItem(end, nil), iterator)
+	}
+	return nil
+}
+
+func (m *memKVStore) Len() int {
+	return m.tree.Len()
+}
+
+func (m *memKVStore) Put(kv *KV) error {
+	m.tree.ReplaceOrInsert((*kVItem)(kv))
+	return nil
+}
+
+func (m *memKVStore) Delete(key string) error {
+	m.tree.Delete(newKVItem(key, nil))
+	return nil
+}
+
+// Snapshot 写时复制，不需要复制全部数据
+func (m *memKVStore) Snapshot() (KVStoreSnapshot, error) {
+	return &memKVStore{tree: m.tree.Clone()}, nil
+}
+
+func (m *memKVStore) Release() {}
+
+func (m *memKVStore) Close() error {
+	return nil
+}
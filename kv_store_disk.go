@@ -0,0 +1,290 @@
+package syncmember
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/btree"
+)
+
+// diskKVStore 保存在磁盘上的KVStore
+//
+// 键值对按写入顺序追加到数据文件中，内存中只保留key到文件偏移的有序索引，
+// 值在读取时才从文件中读出，数据量不受内存限制。
+// 删除和覆盖留下的旧记录在超过文件的一半时通过重写文件清理，存在未释放的快照时推迟清理。
+//
+// 与预写日志相同，写入不对每条记录fsync，Close时同步到磁盘。
+type diskKVStore struct {
+	path string
+
+	// 快照持有旧文件时，文件在所有快照释放后关闭
+	file *diskKVFile
+	size int64
+	// key -> 偏移
+	index *btree.BTree
+	// 已被覆盖或删除的记录大小
+	garbage int64
+
+	snapshots atomic.Int32
+}
+
+// 旧记录至少达到该大小才清理
+const diskKVCompactMin = 1 << 20
+
+type diskKVFile struct {
+	f    *os.File
+	refs atomic.Int32
+}
+
+func (f *diskKVFile) acquire() {
+	f.refs.Add(1)
+}
+
+func (f *diskKVFile) release() {
+	if f.refs.Add(-1) == 0 {
+		f.f.Close()
+	}
+}
+
+type diskKVIndex struct {
+	key    string
+	offset int64
+	size   int64
+}
+
+func (d *diskKVIndex) Less(than btree.Item) bool {
+	return d.key < than.(*diskKVIndex).key
+}
+
+/*
+OpenDiskKVStore 打开path处的数据文件，不存在时创建
+
+文件末尾崩溃时未写完的记录会被丢弃
+*/
+func OpenDiskKVStore(path string) (KVStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	d := &diskKVStore{
+		path:  path,
+		file:  &diskKVFile{f: f},
+		index: btree.New(32),
+	}
+	d.file.acquire()
+	var offset int64
+	end := scanKVRecords(f, func(rec *kvRecord, size int64) {
+		d.replace(rec.Item.Key)
+		if rec.Remove {
+			d.index.Delete(&diskKVIndex{key: rec.Item.Key})
+			d.garbage += size
+		} else {
+			d.index.ReplaceOrInsert(&diskKVIndex{key: rec.Item.Key, offset: offset, size: size})
+		}
+		offset += size
+	})
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, err
+	}
+	d.size = end
+	return d, nil
+}
+
+// replace 记录key原有的记录成为旧记录
+func (d *diskKVStore) replace(key string) {
+	if old := d.index.Get(&diskKVIndex{key: key}); old != nil {
+		d.garbage += old.(*diskKVIndex).size
+	}
+}
+
+func readDiskKV(f *os.File, idx *diskKVIndex) (*KV, error) {
+	buf := make([]byte, idx.size)
+	if _, err := f.ReadAt(buf, idx.offset); err != nil {
+		return nil, fmt.Errorf("read kv %q: %w", idx.key, err)
+	}
+	rec, err := decodeKVRecord(buf[:kvRecordHeader], buf[kvRecordHeader:])
+	if err != nil {
+		return nil, fmt.Errorf("read kv %q: %w", idx.key, err)
+	}
+	item := rec.Item.item()
+	item.stored = rec.Stored
+	return (*KV)(item), nil
+}
+
+func (d *diskKVStore) Get(key string) (*KV, error) {
+	idx := d.index.Get(&diskKVIndex{key: key})
+	if idx == nil {
+		return nil, nil
+	}
+	return readDiskKV(d.file.f, idx.(*diskKVIndex))
+}
+
+func (d *diskKVStore) Ascend(start, end string, fn func(kv *KV) bool) error {
+	return ascendDiskKV(d.index, d.file.f, start, end, fn)
+}
+
+func ascendDiskKV(index *btree.BTree, f *os.File, start, end string, fn func(kv *KV) bool) error {
+	var err error
+	iterator := func(i btree.Item) bool {
+		var kv *KV
+		kv, err = readDiskKV(f, i.(*diskKVIndex))
+		if err != nil {
+			return false
+		}
+		return fn(kv)
+	}
+	if end == "" {
+		index.AscendGreaterOrEqual(&diskKVIndex{key: start}, iterator)
+	} else {
+		index.AscendRange(&diskKVIndex{key: start}, &diskKVIndex{key: end}, iterator)
+	}
+	return err
+}
+
+func (d *diskKVStore) Len() int {
+	return d.index.Len()
+}
+
+func (d *diskKVStore) append(rec *kvRecord) (int64, error) {
+	w := &offsetWriter{f: d.file.f, offset: d.size}
+	if err := writeKVRecord(w, rec); err != nil {
+		return 0, err
+	}
+	size := w.offset - d.size
+	d.size = w.offset
+	return size, nil
+}
+
+func (d *diskKVStore) Put(kv *KV) error {
+	item := (*kVItem)(kv)
+	offset := d.size
+	size, err := d.append(&kvRecord{Item: item.payload(), Stored: item.stored})
+	if err != nil {
+		return err
+	}
+	d.replace(item.key)
+	d.index.ReplaceOrInsert(&diskKVIndex{key: item.key, offset: offset, size: size})
+	return d.maybeCompact()
+}
+
+func (d *diskKVStore) Delete(key string) error {
+	if d.index.Get(&diskKVIndex{key: key}) == nil {
+		return nil
+	}
+	size, err := d.append(&kvRecord{Remove: true, Item: KeyValuePayload{Key: key}})
+	if err != nil {
+		return err
+	}
+	d.replace(key)
+	d.index.Delete(&diskKVIndex{key: key})
+	d.garbage += size
+	return d.maybeCompact()
+}
+
+// maybeCompact 旧记录超过文件的一半时重写文件
+func (d *diskKVStore) maybeCompact() error {
+	if d.garbage < diskKVCompactMin || d.garbage*2 < d.size || d.snapshots.Load() > 0 {
+		return nil
+	}
+	return d.compact()
+}
+
+// compact 把当前的全部记录写入新文件后替换旧文件
+func (d *diskKVStore) compact() error {
+	tmpPath := d.path + ".compact"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	index := btree.New(32)
+	w := &offsetWriter{f: f}
+	var copyErr error
+	d.index.Ascend(func(i btree.Item) bool {
+		idx := i.(*diskKVIndex)
+		buf := make([]byte, idx.size)
+		if _, copyErr = d.file.f.ReadAt(buf, idx.offset); copyErr != nil {
+			return false
+		}
+		index.ReplaceOrInsert(&diskKVIndex{key: idx.key, offset: w.offset, size: idx.size})
+		_, copyErr = w.Write(buf)
+		return copyErr == nil
+	})
+	if copyErr == nil {
+		copyErr = f.Sync()
+	}
+	if copyErr == nil {
+		copyErr = os.Rename(tmpPath, d.path)
+	}
+	if copyErr != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return copyErr
+	}
+	d.file.release()
+	d.file = &diskKVFile{f: f}
+	d.file.acquire()
+	d.index = index
+	d.size = w.offset
+	d.garbage = 0
+	return nil
+}
+
+// Snapshot 复制索引，数据文件只追加，快照期间旧偏移仍然有效
+func (d *diskKVStore) Snapshot() (KVStoreSnapshot, error) {
+	d.snapshots.Add(1)
+	d.file.acquire()
+	return &diskKVSnapshot{store: d, file: d.file, index: d.index.Clone()}, nil
+}
+
+func (d *diskKVStore) Close() error {
+	if err := d.file.f.Sync(); err != nil {
+		return err
+	}
+	d.file.release()
+	return nil
+}
+
+type diskKVSnapshot struct {
+	store *diskKVStore
+	file  *diskKVFile
+	index *btree.BTree
+	once  sync.Once
+}
+
+func (s *diskKVSnapshot) Get(key string) (*KV, error) {
+	idx := s.index.Get(&diskKVIndex{key: key})
+	if idx == nil {
+		return nil, nil
+	}
+	return readDiskKV(s.file.f, idx.(*diskKVIndex))
+}
+
+func (s *diskKVSnapshot) Ascend(start, end string, fn func(kv *KV) bool) error {
+	return ascendDiskKV(s.index, s.file.f, start, end, fn)
+}
+
+func (s *diskKVSnapshot) Len() int {
+	return s.index.Len()
+}
+
+func (s *diskKVSnapshot) Release() {
+	s.once.Do(func() {
+		s.file.release()
+		s.store.snapshots.Add(-1)
+	})
+}
+
+// offsetWriter 从offset开始写入文件
+type offsetWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,133 @@
+package syncmember
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func storeKeys(t *testing.T, r KVReader, start, end string) []string {
+	t.Helper()
+	var keys []string
+	assert.NoError(t, r.Ascend(start, end, func(kv *KV) bool {
+		keys = append(keys, kv.Key())
+		return true
+	}))
+	return keys
+}
+
+func testKVStore(t *testing.T, store KVStore) {
+	for _, key := range []string{"b", "a", "c", "d"} {
+		assert.NoError(t, store.Put((*KV)(newKVItem(key, []byte("v"+key)))))
+	}
+	tomb := &kVItem{key: "e", deleted: true, timestamp: 7, origin: "n", stored: 9}
+	assert.NoError(t, store.Put((*KV)(tomb)))
+	assert.NoError(t, store.Put((*KV)(newKVItem("a", []byte("new")))))
+	assert.NoError(t, store.Delete("d"))
+	assert.NoError(t, store.Delete("missing"))
+
+	kv, err := store.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(kv.Value()))
+	kv, err = store.Get("d")
+	assert.NoError(t, err)
+	assert.Nil(t, kv)
+	kv, err = store.Get("e")
+	assert.NoError(t, err)
+	assert.Equal(t, *tomb, kVItem(*kv))
+
+	assert.Equal(t, 4, store.Len())
+	assert.Equal(t, []string{"a", "b", "c", "e"}, storeKeys(t, store, "", ""))
+	assert.Equal(t, []string{"b", "c"}, storeKeys(t, store, "b", "e"))
+
+	// 快照不受之后的写入影响
+	snapshot, err := store.Snapshot()
+	assert.NoError(t, err)
+	assert.NoError(t, store.Put((*KV)(newKVItem("f", nil))))
+	assert.NoError(t, store.Delete("a"))
+	assert.Equal(t, []string{"a", "b", "c", "e"}, storeKeys(t, snapshot, "", ""))
+	kv, err = snapshot.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(kv.Value()))
+	snapshot.Release()
+	assert.Equal(t, []string{"b", "c", "e", "f"}, storeKeys(t, store, "", ""))
+}
+
+func TestMemKVStore(t *testing.T) {
+	testKVStore(t, NewMemKVStore())
+}
+
+func TestDiskKVStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.data")
+	store, err := OpenDiskKVStore(path)
+	assert.NoError(t, err)
+	testKVStore(t, store)
+	assert.NoError(t, store.Close())
+
+	// 重新打开后数据不变
+	store, err = OpenDiskKVStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, []string{"b", "c", "e", "f"}, storeKeys(t, store, "", ""))
+	kv, err := store.Get("e")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(9), kv.stored)
+}
+
+func TestDiskKVStoreCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.data")
+	store, err := OpenDiskKVStore(path)
+	assert.NoError(t, err)
+	disk := store.(*diskKVStore)
+
+	value := make([]byte, 1024)
+	for i := 0; i < 4*diskKVCompactMin/len(value); i++ {
+		assert.NoError(t, store.Put((*KV)(newKVItem(fmt.Sprint(i%10), value))))
+	}
+	// 反复覆盖同一批key，旧记录被清理，文件不会无限增长
+	assert.Less(t, disk.size, int64(2*diskKVCompactMin))
+	assert.Equal(t, 10, store.Len())
+	assert.NoError(t, store.Close())
+
+	store, err = OpenDiskKVStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, 10, store.Len())
+	kv, err := store.Get("3")
+	assert.NoError(t, err)
+	assert.Len(t, kv.Value(), len(value))
+}
+
+func TestSyncMemberDiskKVStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.data")
+	open := func() *SyncMember {
+		store, err := OpenDiskKVStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newTestMember(t, "127.0.0.1:9101")
+		s.config.KVStore = store
+		s.openKVStore()
+		return s
+	}
+
+	s := open()
+	s.SetKV("a", []byte("1"))
+	s.SetKV("b", []byte("2"))
+	s.DeleteKV("b")
+	assert.Equal(t, []KVPair{{Key: "a", Value: []byte("1")}}, s.ListKV(""))
+	root := s.kvMerkle.levels[0][0]
+	s.closeKVData()
+
+	// 重新打开后从存储中恢复索引
+	restored := open()
+	defer restored.closeKVData()
+	assert.Equal(t, "1", string(restored.GetValue("a")))
+	assert.Nil(t, restored.GetValue("b"))
+	restored.kvTreeMu.RLock()
+	assert.Contains(t, restored.tombstones, "b")
+	assert.Equal(t, root, restored.kvMerkle.levels[0][0])
+	restored.kvTreeMu.RUnlock()
+}
@@ -1,17 +1,19 @@
 package syncmember_test
 
 import (
+	"context"
+	"fmt"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/ciiim/syncmember"
+	"github.com/ciiim/syncmember/transport"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestKVWatcher(t *testing.T) {
-	s1 := syncmember.NewSyncMember("node1", syncmember.DefaultConfig())
-
-	defer s1.Shutdown()
+	s1 := newMemNode(t, transport.NewMemNetwork(), 0, nil)
 
 	setCh := s1.WaitKVSet("key1")
 	updateCh := s1.WaitKVUpdate("key1")
@@ -44,3 +46,358 @@ func TestKVWatcher(t *testing.T) {
 		t.Fatal("key1 delete timeout")
 	}
 }
+
+func TestKVPushPullSync(t *testing.T) {
+	network := transport.NewMemNetwork()
+	seed := newMemNode(t, network, 0, nil)
+	for i := 0; i < 500; i++ {
+		seed.SetKV(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)))
+	}
+
+	// 加入之前写入的数据无法通过Gossip到达其他节点
+	late := []*syncmember.SyncMember{newMemNode(t, network, 1, nil), newMemNode(t, network, 2, nil)}
+	late[1].SetKV("late", []byte("value"))
+	for _, s := range late {
+		if err := s.Join(seed.Node().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 加入时的pushPull即可获得已有数据
+	for _, s := range late {
+		assert.Equal(t, "value499", string(s.GetValue("key499")))
+	}
+	assert.Equal(t, "value", string(seed.GetValue("late")))
+
+	// late[0]只能通过周期性的pushPull获得late[1]加入前写入的数据
+	waitFor(t, 10*time.Second, func() bool {
+		return string(late[0].GetValue("late")) == "value"
+	}, "late key did not reach every node")
+}
+
+func TestEphemeralKV(t *testing.T) {
+	nodes := newMemCluster(t, transport.NewMemNetwork(), 3, nil)
+	waitConverged(t, nodes, 5*time.Second)
+
+	reasons := make(chan string, 1)
+	nodes[0].SetKVWatcher("service/node2", syncmember.EventKVDelete, func(kv *syncmember.KV) {
+		reasons <- kv.Reason()
+	})
+	nodes[2].SetEphemeralKV("service/node2", []byte("127.0.0.1:8080"))
+	nodes[2].SetKV("config", []byte("value"))
+	waitFor(t, 5*time.Second, func() bool {
+		for _, s := range nodes[:2] {
+			if s.GetValue("service/node2") == nil || s.GetValue("config") == nil {
+				return false
+			}
+		}
+		return true
+	}, "keys not replicated")
+
+	nodes[2].Shutdown()
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, syncmember.ReasonOwnerDead, reason)
+	case <-time.After(10 * time.Second):
+		t.Fatal("ephemeral key not deleted after owner died")
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		return nodes[1].GetValue("service/node2") == nil
+	}, "ephemeral key not deleted on every node")
+
+	// 普通键值对不受影响
+	assert.Equal(t, "value", string(nodes[0].GetValue("config")))
+}
+
+func TestWatchPrefix(t *testing.T) {
+	s1 := newMemNode(t, transport.NewMemNetwork(), 0, nil)
+
+	keys := make(chan string, 4)
+	s1.WatchPrefix("config/", []syncmember.KVEventType{syncmember.EventKVSet, syncmember.EventKVDelete}, func(kv *syncmember.KV) {
+		keys <- kv.Key()
+	})
+
+	// 注册之后才出现的key
+	s1.SetKV("config/a", []byte("1"))
+	s1.SetKV("other/a", []byte("1"))
+	s1.UpdateKV("config/a", []byte("2"))
+	s1.DeleteKV("config/a")
+
+	for _, want := range []string{"config/a", "config/a"} {
+		select {
+		case key := <-keys:
+			assert.Equal(t, want, key)
+		case <-time.After(time.Second):
+			t.Fatal("prefix watcher not fired")
+		}
+	}
+	select {
+	case key := <-keys:
+		t.Fatalf("unexpected event for %s", key)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	s1.RemovePrefixWatcher("config/", []syncmember.KVEventType{syncmember.EventKVSet, syncmember.EventKVDelete})
+	s1.SetKV("config/b", []byte("1"))
+	select {
+	case key := <-keys:
+		t.Fatalf("removed watcher fired for %s", key)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMultipleKVWatchers(t *testing.T) {
+	s1 := newMemNode(t, transport.NewMemNetwork(), 0, nil)
+
+	first := make(chan string, 2)
+	second := make(chan string, 2)
+	id := s1.SetKVWatcher("key", syncmember.EventKVSet, func(kv *syncmember.KV) {
+		first <- string(kv.Value())
+	})
+	s1.SetKVWatcher("key", syncmember.EventKVSet, func(kv *syncmember.KV) {
+		second <- string(kv.Value())
+	})
+	// WaitKVSet不会覆盖已有的watcher
+	wait := s1.WaitKVSet("key")
+
+	s1.SetKV("key", []byte("v1"))
+	for _, c := range []chan string{first, second} {
+		select {
+		case v := <-c:
+			assert.Equal(t, "v1", v)
+		case <-time.After(time.Second):
+			t.Fatal("watcher not fired")
+		}
+	}
+	select {
+	case v := <-wait:
+		assert.Equal(t, "v1", string(v))
+	case <-time.After(time.Second):
+		t.Fatal("WaitKVSet not fired")
+	}
+
+	// 只取消第一个watcher
+	s1.CancelKVWatcher(id)
+	s1.DeleteKV("key")
+	s1.SetKV("key", []byte("v2"))
+	select {
+	case v := <-second:
+		assert.Equal(t, "v2", v)
+	case <-time.After(time.Second):
+		t.Fatal("remaining watcher not fired")
+	}
+	select {
+	case v := <-first:
+		t.Fatalf("cancelled watcher fired with %s", v)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s1 := newMemNode(t, transport.NewMemNetwork(), 0, nil)
+
+	next := func(c <-chan syncmember.KVEvent) syncmember.KVEvent {
+		t.Helper()
+		select {
+		case ev, ok := <-c:
+			if !ok {
+				t.Fatal("watch closed")
+			}
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("event not received")
+		}
+		return syncmember.KVEvent{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := s1.Watch(ctx, "app/", syncmember.WithPrefix())
+
+	s1.SetKV("app/a", []byte("v1"))
+	set := next(events)
+	assert.Equal(t, syncmember.EventKVSet, set.Type)
+	assert.Equal(t, "app/a", set.Key)
+	assert.Nil(t, set.Old)
+	assert.Equal(t, "v1", string(set.New))
+
+	s1.UpdateKV("app/a", []byte("v2"))
+	update := next(events)
+	assert.Equal(t, syncmember.EventKVUpdate, update.Type)
+	assert.Equal(t, "v1", string(update.Old))
+	assert.Equal(t, "v2", string(update.New))
+	assert.Greater(t, update.Revision, set.Revision)
+
+	s1.DeleteKV("app/a")
+	del := next(events)
+	assert.Equal(t, syncmember.EventKVDelete, del.Type)
+	assert.Equal(t, "v2", string(del.Old))
+	assert.Nil(t, del.New)
+	assert.Equal(t, syncmember.ReasonDeleted, del.Reason)
+
+	// 前缀之外的key不会收到
+	s1.SetKV("other", []byte("v"))
+
+	cancel()
+	select {
+	case ev, ok := <-events:
+		assert.False(t, ok, "unexpected event %v", ev)
+	case <-time.After(time.Second):
+		t.Fatal("watch not closed after cancel")
+	}
+}
+
+func TestWatchOverflow(t *testing.T) {
+	s1 := newMemNode(t, transport.NewMemNetwork(), 0, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	closing := s1.Watch(ctx, "k", syncmember.WithPrefix(), syncmember.WithBufferSize(1))
+	dropping := s1.Watch(ctx, "k", syncmember.WithPrefix(), syncmember.WithBufferSize(1),
+		syncmember.WithOverflowPolicy(syncmember.OverflowDropNewest))
+
+	for i := 0; i < 5; i++ {
+		s1.SetKV(fmt.Sprintf("k%d", i), []byte("v"))
+	}
+	// 等待事件投递完毕再读取
+	time.Sleep(100 * time.Millisecond)
+
+	// OverflowClose 读完缓冲区后channel被关闭
+	deadline := time.After(time.Second)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-closing:
+			closed = !ok
+		case <-deadline:
+			t.Fatal("watch not closed on overflow")
+		}
+	}
+
+	// OverflowDropNewest 只保留缓冲区中的事件，channel仍然可用
+	select {
+	case ev := <-dropping:
+		assert.Equal(t, syncmember.EventKVSet, ev.Type)
+	case <-time.After(time.Second):
+		t.Fatal("event not received")
+	}
+	s1.SetKV("k9", []byte("v"))
+	select {
+	case ev, ok := <-dropping:
+		assert.True(t, ok)
+		assert.Equal(t, "k9", ev.Key)
+	case <-time.After(time.Second):
+		t.Fatal("event not received after drain")
+	}
+}
+
+func TestKVWatcherOrder(t *testing.T) {
+	s1 := newMemNode(t, transport.NewMemNetwork(), 0, nil)
+
+	const n = 50
+	release := make(chan struct{})
+	got := make(chan string, n)
+	s1.SetKVWatcher("key", syncmember.EventKVUpdate, func(kv *syncmember.KV) {
+		<-release
+		got <- string(kv.Value())
+	})
+
+	s1.SetKV("key", []byte("v0"))
+	for i := 1; i <= n; i++ {
+		s1.UpdateKV("key", []byte(fmt.Sprintf("v%d", i)))
+	}
+	// 回调阻塞时写入不受影响，事件在队列中等待
+	stats := s1.KVDispatchStats()
+	assert.Greater(t, stats.Pending, 0)
+	assert.GreaterOrEqual(t, stats.MaxDepth, stats.Pending)
+	assert.Len(t, stats.Depths, 16)
+
+	close(release)
+	for i := 1; i <= n; i++ {
+		select {
+		case v := <-got:
+			assert.Equal(t, fmt.Sprintf("v%d", i), v)
+		case <-time.After(time.Second):
+			t.Fatal("watcher not fired")
+		}
+	}
+	assert.Eventually(t, func() bool {
+		return s1.KVDispatchStats().Pending == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestListAndWatch(t *testing.T) {
+	s1 := newMemNode(t, transport.NewMemNetwork(), 0, nil)
+
+	s1.SetKV("app/a", []byte("0"))
+	s1.SetKV("app/b", []byte("b"))
+	s1.SetKV("other", []byte("o"))
+
+	const n = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= n; i++ {
+			s1.UpdateKV("app/a", []byte(fmt.Sprint(i)))
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	snapshot, events := s1.ListAndWatch(ctx, "app/", syncmember.WithBufferSize(n))
+	<-done
+
+	assert.Len(t, snapshot.Pairs, 2)
+	assert.Equal(t, "app/a", snapshot.Pairs[0].Key)
+	assert.Equal(t, "app/b", snapshot.Pairs[1].Key)
+
+	// 事件从快照之后开始，前后衔接
+	last := string(snapshot.Pairs[0].Value)
+	revision := snapshot.Revision
+	for last != fmt.Sprint(n) {
+		select {
+		case ev := <-events:
+			assert.Equal(t, "app/a", ev.Key)
+			assert.Equal(t, last, string(ev.Old))
+			assert.Greater(t, ev.Revision, revision)
+			last, revision = string(ev.New), ev.Revision
+		case <-time.After(time.Second):
+			t.Fatalf("missing events after %s", last)
+		}
+	}
+}
+
+func TestKVRestart(t *testing.T) {
+	dir := t.TempDir()
+	network := transport.NewMemNetwork()
+	configure := func(c *syncmember.Config) {
+		c.SetDataDir(dir)
+	}
+	s1 := newMemNode(t, network, 0, configure)
+	s1.SetKV("key", []byte("value"))
+	s1.SetKV("gone", []byte("value"))
+	s1.DeleteKV("gone")
+	s1.Shutdown()
+
+	s2 := newMemNode(t, network, 0, configure)
+	assert.Equal(t, "value", string(s2.GetValue("key")))
+	assert.Nil(t, s2.GetValue("gone"))
+}
+
+func TestDiskKVStoreRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.data")
+	network := transport.NewMemNetwork()
+	open := func() *syncmember.SyncMember {
+		store, err := syncmember.OpenDiskKVStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newMemNode(t, network, 0, func(c *syncmember.Config) {
+			c.SetKVStore(store)
+		})
+	}
+	s1 := open()
+	s1.SetKV("key", []byte("value"))
+	s1.Shutdown()
+
+	s2 := open()
+	assert.Equal(t, "value", string(s2.GetValue("key")))
+}
@@ -0,0 +1,144 @@
+package syncmember
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ciiim/syncmember/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKVTombstone(t *testing.T) {
+	a := newTestMember(t, "127.0.0.1:9101")
+	b := newTestMember(t, "127.0.0.1:9102")
+	a.SetKV("key", []byte("value"))
+	b.mergeKV(a.leafKVs([]uint32{merkleLeaf("key")}))
+	stale := b.leafKVs([]uint32{merkleLeaf("key")})
+
+	a.DeleteKV("key")
+	assert.Nil(t, a.GetValue("key"))
+
+	// 错过删除的节点发来的旧数据不会让key复活
+	a.applyKV(KVSet, &stale[0])
+	a.mergeKV(stale)
+	assert.Nil(t, a.GetValue("key"))
+
+	b.mergeKV(a.leafKVs([]uint32{merkleLeaf("key")}))
+	assert.Nil(t, b.GetValue("key"))
+	assert.Equal(t, a.kvDigests(0, []uint32{0}), b.kvDigests(0, []uint32{0}))
+
+	// 删除后可以重新写入
+	a.SetKV("key", []byte("again"))
+	assert.Equal(t, "again", string(a.GetValue("key")))
+}
+
+func TestKVTombstoneGC(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	a := newTestMember(t, "127.0.0.1:9101")
+	a.clock = fake
+	peer := newNode(resolveAddr("127.0.0.1:9102"), nil)
+	peer.setAlive(DefaultCredibility)
+	a.addNode(peer)
+
+	a.SetKV("key1", []byte("value"))
+	a.SetKV("key2", []byte("value"))
+	a.DeleteKV("key1")
+	a.DeleteKV("key2")
+
+	// 存活节点尚未同步，墓碑保留
+	a.gcTombstones()
+	assert.Len(t, a.tombstones, 2)
+
+	// 存活节点在墓碑写入后完成了同步
+	a.markKVSynced(peer.Addr(), a.hlc.now(fake.Now()))
+	a.gcTombstones()
+	assert.Len(t, a.tombstones, 0)
+
+	// 超过保留时间
+	a.SetKV("key1", []byte("value"))
+	a.DeleteKV("key1")
+	a.gcTombstones()
+	assert.Len(t, a.tombstones, 1)
+	fake.Advance(a.config.TombstoneGracePeriod)
+	a.gcTombstones()
+	assert.Len(t, a.tombstones, 0)
+	assert.Equal(t, 0, a.kvStore.Len())
+}
+
+// syncKVPair 模拟一次由initiator发起的pushPull KV同步
+func syncKVPair(initiator, responder *SyncMember) {
+	start := initiator.hlc.now(initiator.clock.Now())
+	leaves := make([]uint32, merkleLeaves)
+	for i := range leaves {
+		leaves[i] = uint32(i)
+	}
+	fromI, fromR := initiator.leafKVs(leaves), responder.leafKVs(leaves)
+	responder.mergeKV(fromI)
+	initiator.mergeKV(fromR)
+	initiator.markKVSynced(responder.me.Addr(), start)
+}
+
+func TestKVTombstoneGCConverge(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	members := []*SyncMember{
+		newTestMember(t, "127.0.0.1:9101"),
+		newTestMember(t, "127.0.0.1:9102"),
+		newTestMember(t, "127.0.0.1:9103"),
+	}
+	for _, s := range members {
+		s.clock = fake
+		for _, peer := range members {
+			if peer == s {
+				continue
+			}
+			node := newNode(peer.me.Addr(), nil)
+			node.setAlive(DefaultCredibility)
+			s.addNode(node)
+		}
+	}
+
+	a := members[0]
+	a.SetKV("key1", []byte("value"))
+	a.SetKV("key2", []byte("value"))
+	for _, s := range members[1:] {
+		syncKVPair(a, s)
+	}
+	a.DeleteKV("key1")
+	a.DeleteKV("key2")
+
+	tombstones := func() []int {
+		n := make([]int, len(members))
+		for i, s := range members {
+			s.kvTreeMu.RLock()
+			n[i] = len(s.tombstones)
+			s.kvTreeMu.RUnlock()
+		}
+		return n
+	}
+	// 每轮每个节点依次与其他所有节点同步后立即清理墓碑
+	// 先清理的节点会在之后的同步中收到其他节点尚未清理的墓碑
+	round := func() {
+		for _, s := range members {
+			for _, peer := range members {
+				if peer != s {
+					fake.Advance(time.Millisecond)
+					syncKVPair(s, peer)
+				}
+			}
+			s.gcTombstones()
+		}
+	}
+	for i := 0; i < 3; i++ {
+		round()
+	}
+	assert.Equal(t, []int{0, 0, 0}, tombstones())
+	// 清理后的墓碑不会再被同步回来
+	for i := 0; i < 3; i++ {
+		round()
+		assert.Equal(t, []int{0, 0, 0}, tombstones())
+	}
+	for _, s := range members {
+		assert.Nil(t, s.GetValue("key1"))
+		assert.Equal(t, 0, s.kvStore.Len())
+	}
+}
@@ -0,0 +1,86 @@
+package syncmember
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expired 是否已过期
+func (k *kVItem) expired(now time.Time) bool {
+	return k.expireAt > 0 && now.UnixMilli() >= k.expireAt
+}
+
+type kvExpiryEntry struct {
+	key      string
+	expireAt int64
+}
+
+// kvExpiryHeap 按过期时间排序的最小堆
+// key被覆盖或删除时不从堆中移除，弹出时再与当前的过期时间比较
+type kvExpiryHeap []kvExpiryEntry
+
+func (h kvExpiryHeap) Len() int           { return len(h) }
+func (h kvExpiryHeap) Less(i, j int) bool { return h[i].expireAt < h[j].expireAt }
+func (h kvExpiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *kvExpiryHeap) Push(x any) {
+	*h = append(*h, x.(kvExpiryEntry))
+}
+
+func (h *kvExpiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+func (s *SyncMember) expire() {
+	for {
+		select {
+		case <-s.expireTicker.C():
+			s.expireKV()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+func (s *SyncMember) expireKV() {
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	if s.kvStore == nil {
+		return
+	}
+	s.expireDue()
+}
+
+// expireDue 将已过期的键值对替换为墓碑并通知watcher
+// 过期时间是写入时确定的绝对时间，各节点独立判断，不需要广播
+// 调用者需要持有kvTreeMu
+func (s *SyncMember) expireDue() {
+	now := s.clock.Now()
+	for s.kvExpiry.Len() > 0 && s.kvExpiry[0].expireAt <= now.UnixMilli() {
+		entry := heap.Pop(&s.kvExpiry).(kvExpiryEntry)
+		item := s.getItem(entry.key)
+		if item == nil || item.deleted || item.expireAt != entry.expireAt {
+			continue
+		}
+		s.putItem(item.tombstone())
+		s.logger.Info("ExpireKV", "key", item.key)
+		s.emitKVEvent(EventKVDelete, item, nil, ReasonExpired)
+	}
+}
+
+// SetKVWithTTL 与SetKV相同，key在ttl后过期
+// ttl转换为绝对时间随数据同步，各节点的时钟需要大致同步
+func (s *SyncMember) SetKVWithTTL(key string, value []byte, ttl time.Duration) {
+	kv := &KeyValuePayload{
+		Key:   key,
+		Value: value,
+	}
+	if ttl > 0 {
+		kv.ExpireAt = s.clock.Now().Add(ttl).UnixMilli()
+	}
+	s.kvOperation(KVSet, kv)
+}
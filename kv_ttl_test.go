@@ -0,0 +1,80 @@
+package syncmember
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ciiim/syncmember/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKVTTL(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	a := newTestMember(t, "127.0.0.1:9101")
+	b := newTestMember(t, "127.0.0.1:9102")
+	a.clock, b.clock = fake, fake
+
+	expired := make(chan *KV, 1)
+	a.SetKVWatcher("session", EventKVDelete, func(kv *KV) {
+		expired <- kv
+	})
+
+	a.SetKVWithTTL("session", []byte("token"), time.Minute)
+	b.mergeKV(a.leafKVs([]uint32{merkleLeaf("session")}))
+	assert.Equal(t, "token", string(b.GetValue("session")))
+
+	// 更新不改变过期时间
+	fake.Advance(30 * time.Second)
+	a.UpdateKV("session", []byte("refreshed"))
+	b.mergeKV(a.leafKVs([]uint32{merkleLeaf("session")}))
+	assert.Equal(t, "refreshed", string(b.GetValue("session")))
+	fake.Advance(30 * time.Second)
+
+	// 到期后立即不可读，清理时通知watcher
+	assert.Nil(t, a.GetValue("session"))
+	assert.Nil(t, b.GetValue("session"))
+	a.expireKV()
+	b.expireKV()
+	select {
+	case kv := <-expired:
+		assert.Equal(t, "session", kv.Key())
+		assert.Equal(t, "refreshed", string(kv.Value()))
+		assert.Equal(t, ReasonExpired, kv.Reason())
+	case <-time.After(time.Second):
+		t.Fatal("expire event not fired")
+	}
+
+	// 各节点独立过期后数据一致
+	assert.Equal(t, a.kvDigests(0, []uint32{0}), b.kvDigests(0, []uint32{0}))
+
+	// 收到已过期的数据时不会写入
+	c := newTestMember(t, "127.0.0.1:9103")
+	c.clock = fake
+	c.mergeKV([]KeyValuePayload{{Key: "old", Value: []byte("v"), Timestamp: 1, ExpireAt: fake.Now().UnixMilli()}})
+	assert.Nil(t, c.GetValue("old"))
+}
+
+func TestKVUpdateKeepsExpire(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	s := newTestMember(t, "127.0.0.1:9101")
+	s.clock = fake
+	s.SetKVWithTTL("session", []byte("v0"), time.Minute)
+	expireAt := s.getLiveItem("session").expireAt
+	assert.NotZero(t, expireAt)
+
+	// UpdateKV、CAS和批量写入都不改变过期时间
+	fake.Advance(time.Second)
+	s.UpdateKV("session", []byte("v1"))
+	assert.Equal(t, expireAt, s.getLiveItem("session").expireAt)
+
+	fake.Advance(time.Second)
+	_, version, _ := s.GetWithVersion("session")
+	_, err := s.CompareAndSwap("session", version, []byte("v2"))
+	assert.NoError(t, err)
+	assert.Equal(t, expireAt, s.getLiveItem("session").expireAt)
+
+	fake.Advance(time.Second)
+	assert.NoError(t, s.ApplyBatch([]KVOp{{Type: KVOpPut, Key: "session", Value: []byte("v3")}}))
+	assert.Equal(t, "v3", string(s.GetValue("session")))
+	assert.Equal(t, expireAt, s.getLiveItem("session").expireAt)
+}
@@ -0,0 +1,217 @@
+package syncmember
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+/*
+KVEvent Watch返回的KV事件
+
+# EventKVSet Old为空
+
+# EventKVDelete New为空，Reason为删除原因
+
+Old和New与本地数据共享内存，不要修改
+*/
+type KVEvent struct {
+	Type KVEventType
+	Key  string
+	Old  []byte
+	New  []byte
+	// 本节点上KV事件的序号，单调递增
+	Revision uint64
+	Reason   string
+}
+
+// OverflowPolicy Watch的缓冲区满时的处理方式
+type OverflowPolicy int8
+
+const (
+	// OverflowClose 关闭channel，调用者需要重新Watch
+	OverflowClose OverflowPolicy = iota
+	// OverflowDropOldest 丢弃缓冲区中最旧的事件
+	OverflowDropOldest
+	// OverflowDropNewest 丢弃新的事件
+	OverflowDropNewest
+)
+
+const DefaultWatchBufferSize = 64
+
+type watchOptions struct {
+	prefix     bool
+	bufferSize int
+	overflow   OverflowPolicy
+	events     []KVEventType
+	// 只接收序号大于after的事件
+	// 分发队列中可能还有注册前产生的事件，需要按序号过滤
+	after uint64
+}
+
+type WatchOption func(*watchOptions)
+
+// WithPrefix 把key作为前缀，监听以其开头的全部key
+func WithPrefix() WatchOption {
+	return func(o *watchOptions) {
+		o.prefix = true
+	}
+}
+
+// WithBufferSize channel的缓冲区大小
+func WithBufferSize(n int) WatchOption {
+	return func(o *watchOptions) {
+		if n > 0 {
+			o.bufferSize = n
+		}
+	}
+}
+
+// WithOverflowPolicy 缓冲区满时的处理方式，默认为OverflowClose
+func WithOverflowPolicy(p OverflowPolicy) WatchOption {
+	return func(o *watchOptions) {
+		o.overflow = p
+	}
+}
+
+// WithEvents 只监听这些事件，默认监听全部事件
+func WithEvents(events ...KVEventType) WatchOption {
+	return func(o *watchOptions) {
+		o.events = events
+	}
+}
+
+// kvStream 一个Watch的channel
+type kvStream struct {
+	mu       sync.Mutex
+	c        chan KVEvent
+	overflow OverflowPolicy
+	closed   bool
+	// channel关闭后关闭done，通知转发协程退出
+	done chan struct{}
+}
+
+// send 发送事件，channel已关闭时返回false
+func (w *kvStream) send(event KVEvent) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	select {
+	case w.c <- event:
+		return true
+	default:
+	}
+	switch w.overflow {
+	case OverflowDropOldest:
+		// 只有本函数写入且持有mu，腾出一个位置后一定能写入
+		select {
+		case <-w.c:
+		default:
+		}
+		w.c <- event
+	case OverflowDropNewest:
+	default:
+		w.closeLocked()
+	}
+	return !w.closed
+}
+
+func (w *kvStream) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closeLocked()
+}
+
+func (w *kvStream) closeLocked() {
+	if !w.closed {
+		w.closed = true
+		close(w.c)
+		close(w.done)
+	}
+}
+
+/*
+Watch 以channel的形式监听key的事件，使用WithPrefix时监听前缀
+
+channel有界，缓冲区满时按OverflowPolicy处理
+ctx取消后停止监听并关闭channel
+*/
+func (s *SyncMember) Watch(ctx context.Context, key string, opts ...WatchOption) <-chan KVEvent {
+	o := newWatchOptions(opts)
+	return s.watch(ctx, key, o)
+}
+
+func newWatchOptions(opts []WatchOption) watchOptions {
+	o := watchOptions{
+		bufferSize: DefaultWatchBufferSize,
+		events:     []KVEventType{EventKVSet, EventKVDelete, EventKVUpdate},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (s *SyncMember) watch(ctx context.Context, key string, o watchOptions) <-chan KVEvent {
+	w := &kvStream{
+		c:        make(chan KVEvent, o.bufferSize),
+		overflow: o.overflow,
+		done:     make(chan struct{}),
+	}
+	id := s.kWatcher.newID()
+	s.kWatcher.add(id, key, o.prefix, o.events, func(event *KVEvent, _ *KV) {
+		if event.Revision <= o.after {
+			return
+		}
+		if !w.send(*event) {
+			s.kWatcher.remove(id)
+		}
+	})
+	// 溢出关闭后ctx可能永远不会取消，也需要退出
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.done:
+		}
+		s.kWatcher.remove(id)
+		w.close()
+	}()
+	return w.c
+}
+
+// KVSnapshot ListAndWatch返回的快照
+type KVSnapshot struct {
+	Pairs []KVPair
+	// 快照对应的事件序号，之后的事件序号都大于Revision
+	Revision uint64
+}
+
+/*
+ListAndWatch 返回以prefix开头的全部键值对的快照，并从快照之后开始监听前缀
+
+快照和注册watcher在同一次kvTreeMu中完成，
+channel中的第一个事件正好是快照之后的第一个变化，不会遗漏也不会重复
+*/
+func (s *SyncMember) ListAndWatch(ctx context.Context, prefix string, opts ...WatchOption) (KVSnapshot, <-chan KVEvent) {
+	o := newWatchOptions(opts)
+	o.prefix = true
+
+	s.kvTreeMu.Lock()
+	defer s.kvTreeMu.Unlock()
+	s.lazyInit()
+	// 先删除已到期的键值对，使快照与之后的删除事件一致
+	s.expireDue()
+	var snapshot KVSnapshot
+	s.ascendLive(prefix, func(item *kVItem) bool {
+		if !strings.HasPrefix(item.key, prefix) {
+			return false
+		}
+		snapshot.Pairs = append(snapshot.Pairs, item.pair())
+		return true
+	})
+	snapshot.Revision = s.kvRevision
+	o.after = snapshot.Revision
+	return snapshot, s.watch(ctx, prefix, o)
+}
@@ -0,0 +1,51 @@
+package syncmember
+
+import (
+	"context"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchOverflowCloseNoLeak(t *testing.T) {
+	s := newTestMember(t, "127.0.0.1:9101")
+	// 先写入一次，等待分发协程退出后再计数
+	s.SetKV("warmup", []byte("v"))
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	// ctx永远不会取消，只能依靠溢出关闭退出
+	c := s.Watch(context.Background(), "k", WithBufferSize(1))
+	s.SetKV("k", []byte("0"))
+	for i := 1; i < 3; i++ {
+		s.UpdateKV("k", []byte(strconv.Itoa(i)))
+	}
+	// 溢出时取消订阅
+	assert.Eventually(t, func() bool {
+		s.kWatcher.watcherMu.Lock()
+		defer s.kWatcher.watcherMu.Unlock()
+		return len(s.kWatcher.subs) == 0
+	}, time.Second, 10*time.Millisecond, "watcher not removed on overflow")
+
+	// 读完缓冲区后channel被关闭
+	deadline := time.After(time.Second)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-c:
+			closed = !ok
+		case <-deadline:
+			t.Fatal("watch not closed on overflow")
+		}
+	}
+
+	// 不用assert.Eventually，它会在另一个协程中检查条件
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatal("forwarding goroutine leaked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -6,6 +6,26 @@ type KVEventType int8
 
 type KV kVItem
 
+// 删除事件的原因
+const (
+	ReasonDeleted   = "deleted"
+	ReasonExpired   = "expired"
+	ReasonOwnerDead = "owner dead"
+)
+
+func (kv *KV) Key() string {
+	return kv.key
+}
+
+func (kv *KV) Value() []byte {
+	return kv.value
+}
+
+// Reason 删除事件的原因，其他事件为空
+func (kv *KV) Reason() string {
+	return kv.reason
+}
+
 /*
 KVEventFunc
 
@@ -27,126 +47,267 @@ const (
 	KVEventNums int8 = 3
 )
 
-var kvWaitExecuteFn = func(s *SyncMember, kvEventType KVEventType, key string, c chan<- []byte) func(kv *KV) {
-	return func(kv *KV) {
-		clone := make([]byte, len(kv.value))
-		copy(clone, kv.value)
-
-		// 删除watcher
-		s.kWatcher.removeWatcher(key, kvEventType)
+// WatchID watcher的订阅编号，用于取消订阅
+type WatchID uint64
 
-		c <- clone
-
-		// 关闭channel
-		close(c)
-	}
+// kvSubscription 一个watcher
+type kvSubscription struct {
+	id     WatchID
+	key    string
+	prefix bool
+	events [KVEventNums]bool
+	fn     kvHandler
 }
 
+// kvHandler watcher的内部回调，kv为兼容KVEventFunc的键值对
+type kvHandler func(event *KVEvent, kv *KV)
+
 type kVWatcher struct {
-	// key -> [set, delete, update]
-	// 置于结构体第一位
-	watchers  map[string][]KVEventFunc
 	watcherMu sync.Mutex
+	nextID    WatchID
+
+	subs map[WatchID]*kvSubscription
+
+	// key -> 订阅，同一个key可以有任意多个watcher
+	watchers map[string]map[WatchID]*kvSubscription
+
+	// prefix -> 订阅
+	prefixWatchers map[string]map[WatchID]*kvSubscription
+	// 前缀长度 -> 该长度的前缀数量
+	// 匹配时只需查找这些长度的前缀，与注册的前缀数量无关
+	prefixLens map[int]int
+
+	// 按key分片的回调队列
+	dispatcher *kvDispatcher
 }
 
 func newKVWatcher() *kVWatcher {
-	return &kVWatcher{
-		watchers: make(map[string][]KVEventFunc),
+	k := &kVWatcher{
+		subs:           make(map[WatchID]*kvSubscription),
+		watchers:       make(map[string]map[WatchID]*kvSubscription),
+		prefixWatchers: make(map[string]map[WatchID]*kvSubscription),
+		prefixLens:     make(map[int]int),
 	}
+	k.dispatcher = newKVDispatcher(k.notify)
+	return k
+}
+
+// newID 预先分配订阅编号，watcher需要在注册前知道自己的编号时使用
+func (k *kVWatcher) newID() WatchID {
+	k.watcherMu.Lock()
+	defer k.watcherMu.Unlock()
+	k.nextID++
+	return k.nextID
 }
 
-func (k *kVWatcher) setWatcher(key string, kvEventType KVEventType, fn KVEventFunc) {
+func (k *kVWatcher) add(id WatchID, key string, prefix bool, events []KVEventType, fn kvHandler) {
+	sub := &kvSubscription{id: id, key: key, prefix: prefix, fn: fn}
+	for _, e := range events {
+		sub.events[e] = true
+	}
 	k.watcherMu.Lock()
 	defer k.watcherMu.Unlock()
-	_, ok := k.watchers[key]
+	index := k.watchers
+	if prefix {
+		index = k.prefixWatchers
+	}
+	subs, ok := index[key]
 	if !ok {
-		k.watchers[key] = make([]KVEventFunc, KVEventNums)
+		subs = make(map[WatchID]*kvSubscription)
+		index[key] = subs
+		if prefix {
+			k.prefixLens[len(key)]++
+		}
 	}
-
-	k.watchers[key][kvEventType] = fn
-
+	subs[id] = sub
+	k.subs[id] = sub
 }
 
-func (k *kVWatcher) removeWatcher(key string, kvEventType KVEventType) {
+func (k *kVWatcher) remove(id WatchID) {
 	k.watcherMu.Lock()
 	defer k.watcherMu.Unlock()
-	watchers, ok := k.watchers[key]
+	k.removeLocked(id)
+}
+
+func (k *kVWatcher) removeLocked(id WatchID) {
+	sub, ok := k.subs[id]
 	if !ok {
 		return
 	}
+	delete(k.subs, id)
+	index := k.watchers
+	if sub.prefix {
+		index = k.prefixWatchers
+	}
+	subs := index[sub.key]
+	delete(subs, id)
+	if len(subs) > 0 {
+		return
+	}
+	delete(index, sub.key)
+	if sub.prefix {
+		if k.prefixLens[len(sub.key)]--; k.prefixLens[len(sub.key)] == 0 {
+			delete(k.prefixLens, len(sub.key))
+		}
+	}
+}
 
-	watchers[kvEventType] = nil
-
-	if watchers[EventKVSet] == nil && watchers[EventKVDelete] == nil && watchers[EventKVUpdate] == nil {
-		delete(k.watchers, key)
+// removeEvent 从key或前缀的所有watcher中移除事件，没有剩余事件的watcher被取消
+func (k *kVWatcher) removeEvent(key string, prefix bool, events []KVEventType) {
+	k.watcherMu.Lock()
+	defer k.watcherMu.Unlock()
+	index := k.watchers
+	if prefix {
+		index = k.prefixWatchers
+	}
+	for id, sub := range index[key] {
+		for _, e := range events {
+			sub.events[e] = false
+		}
+		if sub.events == [KVEventNums]bool{} {
+			k.removeLocked(id)
+		}
 	}
 }
 
-func (s *SyncMember) SetKVWatcher(key string, kvEventType KVEventType, fn KVEventFunc) {
-	s.kWatcher.setWatcher(key, kvEventType, fn)
+// SetKVWatcher 监听key的事件，同一个key可以注册多个watcher
+// 返回的WatchID用于CancelKVWatcher
+func (s *SyncMember) SetKVWatcher(key string, kvEventType KVEventType, fn KVEventFunc) WatchID {
+	id := s.kWatcher.newID()
+	s.kWatcher.add(id, key, false, []KVEventType{kvEventType}, func(_ *KVEvent, kv *KV) {
+		fn(kv)
+	})
+	return id
 }
 
+// RemoveKVWatcher 移除key上该事件的全部watcher
 func (s *SyncMember) RemoveKVWatcher(key string, kvEventType KVEventType) {
-	s.kWatcher.removeWatcher(key, kvEventType)
+	s.kWatcher.removeEvent(key, false, []KVEventType{kvEventType})
+}
+
+// CancelKVWatcher 只取消id对应的watcher，不影响同一个key上的其他watcher
+func (s *SyncMember) CancelKVWatcher(id WatchID) {
+	s.kWatcher.remove(id)
 }
 
-func (s *SyncMember) notifyKVWatcher(kvEventType KVEventType, item *kVItem) {
-	fn := s.getKVWatcherFunc(item.key, kvEventType)
+/*
+WatchPrefix 监听以prefix开头的全部key，包括注册之后才出现的key
 
-	if fn == nil {
+返回的WatchID用于CancelKVWatcher
+*/
+func (s *SyncMember) WatchPrefix(prefix string, events []KVEventType, fn KVEventFunc) WatchID {
+	id := s.kWatcher.newID()
+	s.kWatcher.add(id, prefix, true, events, func(_ *KVEvent, kv *KV) {
+		fn(kv)
+	})
+	return id
+}
+
+// RemovePrefixWatcher 移除前缀上这些事件的全部watcher
+func (s *SyncMember) RemovePrefixWatcher(prefix string, events []KVEventType) {
+	s.kWatcher.removeEvent(prefix, true, events)
+}
+
+// emitKVEvent 生成KV事件并通知watcher
+// 删除事件的oldItem为删除前的键值对，其余事件的newItem为写入后的键值对
+// 调用者需要持有kvTreeMu，事件的序号与写入顺序一致
+func (s *SyncMember) emitKVEvent(kvEventType KVEventType, oldItem, newItem *kVItem, reason string) {
+	s.kvRevision++
+	event := &KVEvent{
+		Type:     kvEventType,
+		Revision: s.kvRevision,
+		Reason:   reason,
+	}
+	var kv KV
+	if oldItem != nil {
+		event.Key = oldItem.key
+		event.Old = oldItem.value
+		kv = KV(*oldItem)
+	}
+	if newItem != nil {
+		event.Key = newItem.key
+		event.New = newItem.value
+		kv = KV(*newItem)
+	}
+	kv.reason = reason
+	task := kvDispatchTask{event: event, kv: &kv}
+	if s.kvBatching {
+		s.kvBatchPending = append(s.kvBatchPending, task)
 		return
 	}
-	fn((*KV)(item))
+	// 放入分发队列，不阻塞写入
+	s.kWatcher.dispatcher.dispatch(task)
 }
 
-func (s *SyncMember) getKVWatcherFunc(key string, kvEventType KVEventType) KVEventFunc {
-	s.kWatcher.watcherMu.Lock()
-	defer s.kWatcher.watcherMu.Unlock()
-	watchers, ok := s.kWatcher.watchers[key]
+func (k *kVWatcher) notify(task kvDispatchTask) {
+	for _, fn := range k.match(task.event.Key, task.event.Type) {
+		fn(task.event, task.kv)
+	}
+}
 
-	// 该key没有被监控
-	if !ok {
-		return nil
+// match 返回key的watcher和所有匹配前缀的watcher
+func (k *kVWatcher) match(key string, kvEventType KVEventType) []kvHandler {
+	k.watcherMu.Lock()
+	defer k.watcherMu.Unlock()
+	var fns []kvHandler
+	for _, sub := range k.watchers[key] {
+		if sub.events[kvEventType] {
+			fns = append(fns, sub.fn)
+		}
 	}
+	for l := range k.prefixLens {
+		if l > len(key) {
+			continue
+		}
+		for _, sub := range k.prefixWatchers[key[:l]] {
+			if sub.events[kvEventType] {
+				fns = append(fns, sub.fn)
+			}
+		}
+	}
+	return fns
+}
 
-	return watchers[kvEventType]
+// waitKV 等待key的一次事件，触发后自动取消
+func (s *SyncMember) waitKV(key string, kvEventType KVEventType) <-chan []byte {
+	c := make(chan []byte, 1)
+	id := s.kWatcher.newID()
+	var once sync.Once
+	s.kWatcher.add(id, key, false, []KVEventType{kvEventType}, func(_ *KVEvent, kv *KV) {
+		once.Do(func() {
+			s.kWatcher.remove(id)
+			clone := make([]byte, len(kv.value))
+			copy(clone, kv.value)
+			c <- clone
+			close(c)
+		})
+	})
+	return c
 }
 
 /*
 WaitKVSet 用于等待某个key被设置
 
 return 设置的值
-
-会覆盖之前的watcher
 */
 func (s *SyncMember) WaitKVSet(key string) <-chan []byte {
-	c := make(chan []byte)
-	s.kWatcher.setWatcher(key, EventKVSet, kvWaitExecuteFn(s, EventKVSet, key, c))
-	return c
+	return s.waitKV(key, EventKVSet)
 }
 
 /*
 WaitKVDelete 用于等待某个key被删除
 
 return 被删除的值
-
-会覆盖之前的watcher
 */
 func (s *SyncMember) WaitKVDelete(key string) <-chan []byte {
-	c := make(chan []byte)
-	s.kWatcher.setWatcher(key, EventKVDelete, kvWaitExecuteFn(s, EventKVDelete, key, c))
-	return c
+	return s.waitKV(key, EventKVDelete)
 }
 
 /*
 WaitKVUpdate 用于等待某个key被更新
 
 return 更新后的值
-
-会覆盖之前的watcher
 */
 func (s *SyncMember) WaitKVUpdate(key string) <-chan []byte {
-	c := make(chan []byte)
-	s.kWatcher.setWatcher(key, EventKVUpdate, kvWaitExecuteFn(s, EventKVUpdate, key, c))
-	return c
+	return s.waitKV(key, EventKVUpdate)
 }
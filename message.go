@@ -24,6 +24,10 @@ func (m MessageType) String() string {
 		return "KVDelete"
 	case KVUpdate:
 		return "KVUpdate"
+	case Compound:
+		return "Compound"
+	case KVBatch:
+		return "KVBatch"
 	default:
 		return "Unknown"
 	}
@@ -39,6 +43,12 @@ const (
 	KVSet
 	KVDelete
 	KVUpdate
+
+	//多条消息合并而成的复合消息，Payload为[]*Message的编码
+	Compound
+
+	//一次ApplyBatch的全部写入，Payload为KVBatchPayload的编码
+	KVBatch
 )
 
 type Message struct {
@@ -59,6 +69,17 @@ type NodeInfoPayload struct {
 	Addr      Address
 	NodeState NodeStateType
 	Version   int64
+	Meta      []byte
+	PublicKey []byte
+
+	//节点支持的协议版本
+	ProtocolMin uint8
+	ProtocolMax uint8
+	ProtocolCur uint8
+
+	//签名者，Alive由节点自己签名，Dead由发现者签名
+	Signer    Address
+	Signature []byte
 }
 
 func (p *NodeInfoPayload) Encode() *bytes.Buffer {
@@ -76,6 +97,24 @@ func (p *NodeInfoPayload) Decode(b []byte) error {
 type KeyValuePayload struct {
 	Key   string
 	Value []byte
+
+	//混合逻辑时钟时间戳和写入节点名称
+	Timestamp uint64
+	Origin    string
+
+	//值的类型，0为普通字节，其余为CRDT类型
+	Kind uint8
+
+	//过期时间，Unix毫秒时间戳，0表示不过期
+	ExpireAt int64
+
+	//临时键值对所属节点的地址，所属节点死亡时删除
+	Owner string
+	//写入时所属节点的版本，所属节点死亡留下的墓碑为死亡通知的版本
+	Incarnation int64
+
+	//是否为删除后留下的墓碑
+	Deleted bool
 }
 
 func (p *KeyValuePayload) Encode() *bytes.Buffer {
@@ -90,6 +129,22 @@ func (p *KeyValuePayload) Decode(b []byte) error {
 	return codec.Unmarshal(b, p)
 }
 
+type KVBatchPayload struct {
+	Items []KeyValuePayload
+}
+
+func (p *KVBatchPayload) Encode() *bytes.Buffer {
+	b, err := codec.Marshal(p)
+	if err != nil {
+		return nil
+	}
+	return bytes.NewBuffer(b)
+}
+
+func (p *KVBatchPayload) Decode(b []byte) error {
+	return codec.Unmarshal(b, p)
+}
+
 func (m *Message) GetPayload() []byte {
 	return m.Payload
 }
@@ -1,6 +1,7 @@
 package syncmember
 
 import (
+	"crypto/ed25519"
 	"sync/atomic"
 )
 
@@ -10,14 +11,36 @@ type NodeLocalInfo struct {
 	credibility atomic.Int32
 }
 
+type nodeProtocol struct {
+	min uint8
+	max uint8
+	cur uint8
+}
+
 type Node struct {
 	address       Address
 	nodeLocalInfo NodeLocalInfo
+
+	publicKey ed25519.PublicKey
+	meta      []byte
+	protocol  nodeProtocol
+
+	//最近一次接受的已签名节点信息，用于转发和pushPull
+	claim NodeInfoPayload
+	//最近一次接受的节点自身签发的信息
+	selfClaim NodeInfoPayload
+	//公钥是否经由pushPull确认，只接受可信成员签发的死亡通知
+	trusted bool
 }
 
 func (s *SyncMember) AddNode(node *Node) {
 	s.nMutex.Lock()
 	defer s.nMutex.Unlock()
+	s.addNode(node)
+}
+
+// 调用者需要持有nMutex
+func (s *SyncMember) addNode(node *Node) {
 	if _, ok := s.nodesMap[node.Addr().String()]; ok {
 		s.logger.Warn("node already exist", "node", node.Addr())
 		return
@@ -34,6 +57,8 @@ func newNode(addr Address, nodeInfo *NodeInfoPayload) *Node {
 			version:     atomic.Int64{},
 			credibility: atomic.Int32{},
 		},
+		//未收到节点自身信息前，假定其只支持基础协议
+		protocol: nodeProtocol{min: protocolBase, max: protocolBase, cur: protocolBase},
 	}
 	if nodeInfo == nil {
 		return n
@@ -45,20 +70,41 @@ func newNode(addr Address, nodeInfo *NodeInfoPayload) *Node {
 				version:     atomic.Int64{},
 				credibility: atomic.Int32{},
 			},
+			protocol: n.protocol,
 		}
 		n.nodeLocalInfo.version.Store(nodeInfo.Version)
+		n.acceptClaim(nodeInfo)
 	}
 	return n
 }
 
+// acceptClaim 记录已通过校验的节点信息
+func (n *Node) acceptClaim(nodeInfo *NodeInfoPayload) {
+	n.claim = *nodeInfo
+	if nodeInfo.isSelfClaim() {
+		n.selfClaim = *nodeInfo
+		if !n.publicKey.Equal(ed25519.PublicKey(nodeInfo.PublicKey)) {
+			//节点更换了密钥，需要重新确认
+			n.trusted = false
+		}
+		n.publicKey = ed25519.PublicKey(nodeInfo.PublicKey)
+		n.meta = nodeInfo.Meta
+		n.protocol = nodeProtocol{
+			min: wireVersion(nodeInfo.ProtocolMin),
+			max: wireVersion(nodeInfo.ProtocolMax),
+			cur: wireVersion(nodeInfo.ProtocolCur),
+		}
+	}
+}
+
 // 改变节点状态，重置节点可信度，增加版本号
-func (n *Node) setAlive() {
+func (n *Node) setAlive(credibility int32) {
 	if n.nodeLocalInfo.nodeState == NodeAlive {
 		return
 	}
 	n.changeState(NodeAlive)
 	n.increaseVersionTo(n.GetInfo().Version + 1)
-	n.becomeCredible()
+	n.becomeCredible(credibility)
 }
 
 // 改变节点状态，重置节点可信度，增加版本号
@@ -75,8 +121,9 @@ func (n *Node) becomeUnCredible() {
 	n.nodeLocalInfo.credibility.Store(0)
 }
 
-func (n *Node) becomeCredible() {
-	n.nodeLocalInfo.credibility.Store(3)
+// 可信度即连续多少轮Ping未收到Pong后判定节点死亡
+func (n *Node) becomeCredible(credibility int32) {
+	n.nodeLocalInfo.credibility.Store(credibility)
 }
 
 func (n *Node) IsCredible() bool {
@@ -103,10 +150,38 @@ func (n *Node) Addr() Address {
 	return n.address
 }
 
+func (n *Node) Meta() []byte {
+	return n.meta
+}
+
+func (n *Node) PublicKey() ed25519.PublicKey {
+	return n.publicKey
+}
+
 func (n *Node) GetInfo() NodeInfoPayload {
 	return NodeInfoPayload{
 		Addr:      n.address,
 		NodeState: n.nodeLocalInfo.nodeState,
 		Version:   n.nodeLocalInfo.version.Load(),
+		Meta:      n.meta,
+		PublicKey: n.publicKey,
+
+		ProtocolMin: n.protocol.min,
+		ProtocolMax: n.protocol.max,
+		ProtocolCur: n.protocol.cur,
 	}
 }
+
+// signedInfo 返回最近一次接受的已签名节点信息
+func (n *Node) signedInfo() NodeInfoPayload {
+	return n.claim
+}
+
+// Members 返回本地已知的其他节点
+func (s *SyncMember) Members() []*Node {
+	s.nMutex.Lock()
+	defer s.nMutex.Unlock()
+	nodes := make([]*Node, len(s.nodes))
+	copy(nodes, s.nodes)
+	return nodes
+}
@@ -6,6 +6,12 @@ type Packet struct {
 	MessageBody *Message
 	From        Address
 	To          Address
+
+	//集群标签，不同标签的数据包会被丢弃
+	Label string
+
+	//解码该数据包所需的协议版本
+	Version uint8
 }
 
 func newPacket(msg *Message, from, to Address) *Packet {
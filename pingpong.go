@@ -3,7 +3,7 @@ package syncmember
 func (s *SyncMember) ping() {
 	for {
 		select {
-		case <-s.pingTicker.C:
+		case <-s.pingTicker.C():
 			s.doPing()
 		case <-s.stopCh:
 			return
@@ -13,11 +13,12 @@ func (s *SyncMember) ping() {
 
 func (s *SyncMember) doPing() {
 
+	s.nMutex.Lock()
+	defer s.nMutex.Unlock()
+
 	//清理超时节点
 	s.clearLimitExceededNode()
 
-	s.nMutex.Lock()
-	defer s.nMutex.Unlock()
 	s.logger.Debug("Ping", "node list length", len(s.nodes))
 	if len(s.nodes) == 0 {
 		return
@@ -33,12 +34,23 @@ func (s *SyncMember) doPing() {
 	//发送Ping消息
 	for _, node := range nodes {
 		packet = newPacket(newPingMessage(), s.host, node.Addr())
-		if err := sendPacket(s.udpTransport, packet); err != nil {
+		if err := s.sendPacket(packet); err != nil {
 			s.logger.Error("SendMsg", "error", err)
 		}
 		s.waitPongMap[node.address.String()] = node
 		s.logger.Debug("Ping", "target node", node.Addr())
 	}
+
+	//尝试联系一个已死亡的节点，网络分区恢复后双方可以重新发现彼此
+	//不加入waitPongMap，未收到Pong不会再次判定死亡
+	for _, node := range kRamdonNodes(1, s.nodes, func(n *Node) bool {
+		return n.NodeState() != NodeDead
+	}) {
+		packet = newPacket(newPingMessage(), s.host, node.Addr())
+		if err := s.sendPacket(packet); err != nil {
+			s.logger.Error("SendMsg", "error", err)
+		}
+	}
 }
 
 func (s *SyncMember) clearLimitExceededNode() {
@@ -50,14 +62,11 @@ func (s *SyncMember) clearLimitExceededNode() {
 			if s.nodeEvent != nil {
 				s.nodeEvent.NotifyDead(node)
 			}
+			s.deleteEphemeralKV(node.address, node.GetInfo().Version)
 
 			delete(s.waitPongMap, k)
-			//添加广播
-			nodePayload := &NodeInfoPayload{
-				Addr:      node.Addr(),
-				NodeState: NodeDead,
-				Version:   node.GetInfo().Version,
-			}
+			//添加广播，死亡通知由本节点签名
+			nodePayload := s.signDead(node)
 			s.boardcastQueue.PutMessage(Dead, node.Addr().String(), nodePayload.Encode().Bytes())
 		} else {
 			node.nodeLocalInfo.credibility.Add(-1)
@@ -71,16 +80,17 @@ func (s *SyncMember) handlePong(packet *Packet) {
 	defer s.nMutex.Unlock()
 	from := packet.From.String()
 
-	//如果一段时间后才收到Pong，且节点为死亡状态，转变为存活节点
+	//死亡节点回复了探测，未签名的Pong不能改变成员状态
+	//将死亡通知发给对方，等待其签名的存活信息反驳
 	node, ok := s.nodesMap[from]
 	if ok && node.nodeLocalInfo.nodeState == NodeDead {
-		s.logger.Warn("[Pong] Node Alive", "this node", node)
-		node.setAlive()
-
-		if s.nodeEvent != nil {
-			s.nodeEvent.NotifyAlive(node)
+		s.logger.Debug("[Pong] Dead node replied", "node", from)
+		if claim := node.signedInfo(); claim.NodeState == NodeDead {
+			deadPacket := newPacket(newMessage(Dead, claim.Encode().Bytes()), s.host, node.Addr())
+			if err := s.sendPacket(deadPacket); err != nil {
+				s.logger.Error("SendMsg", "error", err)
+			}
 		}
-
 		return
 	}
 	if !ok {
@@ -94,7 +104,7 @@ func (s *SyncMember) handlePong(packet *Packet) {
 		s.logger.Warn("Unknown Pong Message", "From", packet.From)
 		return
 	}
-	node.becomeCredible()
+	node.becomeCredible(s.config.Credibility)
 	delete(s.waitPongMap, from)
 }
 
@@ -102,15 +112,20 @@ func (s *SyncMember) handlePong(packet *Packet) {
 func (s *SyncMember) handlePing(packet *Packet) {
 	s.nMutex.Lock()
 	_, ok := s.nodesMap[packet.From.String()]
+	admitted := s.admitted(packet.From)
 	s.nMutex.Unlock()
+	if !admitted {
+		s.logger.Warn("Refused Ping from unjoined node", "node addr", packet.From)
+		return
+	}
 	if !ok {
-		s.logger.Warn("Received an unknown Ping", "node addr", packet.From)
-	} else {
-		//创建一个Pong消息
-		PongPacket := newPacket(newPongMessage(packet.MessageBody.Seq), s.host, packet.From)
-		if err := sendPacket(s.udpTransport, PongPacket); err != nil {
-			s.logger.Error("SendMsg", "error", err)
-		}
+		//对方可能先通过Gossip得知本节点，本节点尚未收到对方的信息
+		//此时仍需回复Pong，否则本节点会被误判为死亡
+		s.logger.Debug("Received an unknown Ping", "node addr", packet.From)
+	}
+	//创建一个Pong消息
+	PongPacket := newPacket(newPongMessage(packet.MessageBody.Seq), s.host, packet.From)
+	if err := s.sendPacket(PongPacket); err != nil {
+		s.logger.Error("SendMsg", "error", err)
 	}
-
 }
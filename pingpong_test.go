@@ -0,0 +1,177 @@
+package syncmember
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ciiim/syncmember/codec"
+	"github.com/ciiim/syncmember/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureTransport 在network中为addr创建端点，返回收到的数据包
+func captureTransport(t *testing.T, network *transport.MemNetwork, addr string) <-chan *Packet {
+	t.Helper()
+	tr, err := network.NewTransport(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *Packet, 16)
+	err = tr.Start(func(p *transport.Packet) {
+		var packet Packet
+		if err := codec.Unmarshal(p.Buffer.Bytes(), &packet); err == nil {
+			received <- &packet
+		}
+	}, func(net.Conn) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = tr.Shutdown()
+	})
+	return received
+}
+
+// useMemTransport 让测试节点通过network发送数据包
+func useMemTransport(t *testing.T, s *SyncMember, network *transport.MemNetwork) {
+	t.Helper()
+	tr, err := network.NewTransport(s.me.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.transport = tr
+	s.host = s.me.Addr()
+}
+
+func nextPacket(t *testing.T, c <-chan *Packet) *Packet {
+	t.Helper()
+	select {
+	case packet := <-c:
+		return packet
+	case <-time.After(time.Second):
+		t.Fatal("no packet received")
+	}
+	return nil
+}
+
+type stateDelegate struct {
+	alive chan *Node
+}
+
+func (d *stateDelegate) NotifyJoin(n *Node) {}
+func (d *stateDelegate) NotifyDead(n *Node) {}
+func (d *stateDelegate) NotifyAlive(n *Node) {
+	d.alive <- n
+}
+
+func TestCredibilityRounds(t *testing.T) {
+	for _, credibility := range []int32{DefaultCredibility, 5} {
+		network := transport.NewMemNetwork()
+		s := newTestMember(t, "127.0.0.1:9101")
+		s.config.SetCredibility(credibility)
+		useMemTransport(t, s, network)
+		peer := newTestMember(t, "127.0.0.1:9102")
+
+		claim := peer.me.signedInfo()
+		s.alive(&claim)
+
+		// 第一轮发出Ping，此后每轮未收到Pong可信度减一，共credibility轮后判定死亡
+		for i := int32(0); i < credibility; i++ {
+			s.doPing()
+			assert.Equal(t, NodeAlive, s.GetNodeState(peer.me.Addr().String()), "round %d", i)
+		}
+		s.doPing()
+		assert.Equal(t, NodeDead, s.GetNodeState(peer.me.Addr().String()))
+	}
+}
+
+func TestPingProbesDeadNode(t *testing.T) {
+	network := transport.NewMemNetwork()
+	s := newTestMember(t, "127.0.0.1:9101")
+	s.config.SetFanout(1)
+	useMemTransport(t, s, network)
+	dead := newTestMember(t, "127.0.0.1:9102")
+	received := captureTransport(t, network, dead.me.Addr().String())
+	alive := newTestMember(t, "127.0.0.1:9103")
+	aliveReceived := captureTransport(t, network, alive.me.Addr().String())
+
+	claim := dead.me.signedInfo()
+	s.alive(&claim)
+	aliveClaim := alive.me.signedInfo()
+	s.alive(&aliveClaim)
+	node := s.nodesMap[dead.me.Addr().String()]
+	node.setDead()
+	s.signDead(node)
+
+	// 死亡节点不参与正常的Ping，不占用Fanout名额，每轮会被单独探测一次
+	s.doPing()
+	assert.Equal(t, Ping, nextPacket(t, received).MessageBody.MsgType)
+	assert.Equal(t, Ping, nextPacket(t, aliveReceived).MessageBody.MsgType)
+	// 探测未收到Pong不会再次判定死亡
+	assert.Len(t, s.waitPongMap, 1)
+	assert.Contains(t, s.waitPongMap, alive.me.Addr().String())
+
+	s.doPing()
+	assert.Equal(t, Ping, nextPacket(t, received).MessageBody.MsgType)
+	assert.Equal(t, NodeDead, s.GetNodeState(dead.me.Addr().String()))
+	assert.Equal(t, claim.Version+1, node.GetInfo().Version)
+}
+
+func TestPongKeepsDeadNode(t *testing.T) {
+	network := transport.NewMemNetwork()
+	s := newTestMember(t, "127.0.0.1:9101")
+	useMemTransport(t, s, network)
+	peer := newTestMember(t, "127.0.0.1:9102")
+	received := captureTransport(t, network, peer.me.Addr().String())
+	delegate := &stateDelegate{alive: make(chan *Node, 1)}
+	s.SetNodeDelegate(delegate)
+
+	// 对方的回复走另一个网络，避免与s的发送端点冲突
+	replyNetwork := transport.NewMemNetwork()
+	useMemTransport(t, peer, replyNetwork)
+	replies := captureTransport(t, replyNetwork, s.me.Addr().String())
+
+	claim := peer.me.signedInfo()
+	s.alive(&claim)
+	selfClaim := s.me.signedInfo()
+	peer.alive(&selfClaim)
+	node := s.nodesMap[peer.me.Addr().String()]
+	node.setDead()
+	deadClaim := s.signDead(node)
+
+	// 未签名的Pong不改变成员状态，已签名的死亡通知仍与本地状态一致
+	s.handlePong(newPacket(newPongMessage(0), peer.me.Addr(), s.me.Addr()))
+	assert.Equal(t, NodeDead, s.GetNodeState(peer.me.Addr().String()))
+	assert.False(t, node.IsCredible())
+	assert.Equal(t, deadClaim, node.signedInfo())
+	select {
+	case <-delegate.alive:
+		t.Fatal("NotifyAlive fired on an unsigned Pong")
+	default:
+	}
+
+	// 死亡通知发给对方，对方反驳并直接回复签名的存活信息
+	packet := nextPacket(t, received)
+	assert.Equal(t, Dead, packet.MessageBody.MsgType)
+	assert.Equal(t, deadClaim.Encode().Bytes(), packet.MessageBody.Payload)
+	peer.handleStateChange(packet.MessageBody, packet.From)
+	assert.Equal(t, deadClaim.Version, peer.me.GetInfo().Version)
+
+	reply := nextPacket(t, replies)
+	assert.Equal(t, Alive, reply.MessageBody.MsgType)
+	s.handleStateChange(reply.MessageBody, reply.From)
+	assert.Equal(t, NodeAlive, s.GetNodeState(peer.me.Addr().String()))
+	assert.Equal(t, NodeAlive, node.signedInfo().NodeState)
+	assert.Equal(t, deadClaim.Version, node.signedInfo().Version)
+	select {
+	case n := <-delegate.alive:
+		assert.Equal(t, node, n)
+	default:
+		t.Fatal("NotifyAlive not fired")
+	}
+
+	// 已经反驳过的死亡通知再次到达时仍直接回复，之前的回复可能已丢失
+	peer.handleStateChange(packet.MessageBody, packet.From)
+	assert.Equal(t, Alive, nextPacket(t, replies).MessageBody.MsgType)
+}
@@ -0,0 +1,77 @@
+package syncmember
+
+import (
+	"fmt"
+)
+
+// 协议版本
+//
+// 每个数据包和pushPull头部都会携带发送方使用的协议版本，
+// 成员信息中会发布节点支持的最小、最大以及当前协议版本。
+// 滚动升级时，新特性只有在所有存活节点都支持时才会被使用。
+const (
+	ProtocolVersionMin uint8 = 1
+	ProtocolVersionMax uint8 = 4
+)
+
+// 各特性引入的协议版本
+const (
+	// 基础成员协议，包含签名的成员信息和元数据
+	protocolBase uint8 = 1
+
+	// 多条Gossip消息合并为一个复合数据包
+	protocolCompound uint8 = 2
+
+	// pushPull交换节点信息后通过Merkle树摘要同步KV数据
+	protocolKVSync uint8 = 3
+
+	// 多个KV写入合并为一条KVBatch消息
+	protocolKVBatch uint8 = 4
+)
+
+// protocolUnversioned 加入协议版本之前的数据包没有版本字段，解码后为0
+// 它们使用的就是基础协议，按protocolBase处理，以便从旧节点滚动升级
+const protocolUnversioned uint8 = 0
+
+// wireVersion 返回收到的协议版本实际对应的版本
+func wireVersion(v uint8) uint8 {
+	if v == protocolUnversioned {
+		return protocolBase
+	}
+	return v
+}
+
+// checkProtocolVersion 判断收到的协议版本是否能被本节点处理
+func checkProtocolVersion(v uint8) error {
+	if v < ProtocolVersionMin || v > ProtocolVersionMax {
+		return fmt.Errorf("unsupported protocol version %d, supported [%d, %d]", v, ProtocolVersionMin, ProtocolVersionMax)
+	}
+	return nil
+}
+
+// compatibleNodeInfo 节点支持的协议版本范围是否与本节点有交集
+func compatibleNodeInfo(p *NodeInfoPayload) bool {
+	return wireVersion(p.ProtocolMin) <= ProtocolVersionMax && wireVersion(p.ProtocolMax) >= ProtocolVersionMin
+}
+
+// clusterProtocol 返回所有存活节点当前都在使用的最高协议版本
+// 滚动升级时节点可能支持更高的版本，但仍设置为使用旧版本，因此以当前版本为准
+// 调用者需要持有nMutex
+func (s *SyncMember) clusterProtocol() uint8 {
+	version := s.config.ProtocolVersion
+	for _, n := range s.nodes {
+		if n.NodeState() != NodeAlive {
+			continue
+		}
+		if n.protocol.cur < version {
+			version = n.protocol.cur
+		}
+	}
+	return version
+}
+
+// supports 集群是否可以使用某个特性
+// 调用者需要持有nMutex
+func (s *SyncMember) supports(feature uint8) bool {
+	return s.clusterProtocol() >= feature
+}
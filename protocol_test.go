@@ -0,0 +1,96 @@
+package syncmember
+
+import (
+	"testing"
+
+	"github.com/ciiim/syncmember/codec"
+	"github.com/ciiim/syncmember/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterProtocol(t *testing.T) {
+	s := newTestMember(t, "127.0.0.1:9101")
+	s.config = DefaultConfig()
+
+	upgraded := newTestMember(t, "127.0.0.1:9102")
+	upgraded.me.protocol = nodeProtocol{min: ProtocolVersionMin, max: ProtocolVersionMax, cur: ProtocolVersionMax}
+	claim := upgraded.signSelf()
+	s.alive(&claim)
+	assert.True(t, s.supports(protocolCompound))
+	assert.True(t, s.supports(protocolKVBatch))
+
+	// 已升级但仍设置为使用旧版本的节点
+	pinned := newTestMember(t, "127.0.0.1:9105")
+	pinned.me.protocol = nodeProtocol{min: ProtocolVersionMin, max: ProtocolVersionMax, cur: protocolCompound}
+	claim = pinned.signSelf()
+	s.alive(&claim)
+	assert.True(t, s.supports(protocolCompound))
+	assert.False(t, s.supports(protocolKVBatch))
+
+	// 旧版本节点加入后，不再使用复合数据包
+	legacy := newTestMember(t, "127.0.0.1:9103")
+	legacy.me.protocol = nodeProtocol{min: protocolBase, max: protocolBase, cur: protocolBase}
+	claim = legacy.signSelf()
+	s.alive(&claim)
+	assert.False(t, s.supports(protocolCompound))
+
+	// 不兼容的节点会被拒绝
+	future := newTestMember(t, "127.0.0.1:9104")
+	future.me.protocol = nodeProtocol{min: ProtocolVersionMax + 1, max: ProtocolVersionMax + 1, cur: ProtocolVersionMax + 1}
+	claim = future.signSelf()
+	s.alive(&claim)
+	assert.Equal(t, NodeUnknown, s.GetNodeState(future.me.Addr().String()))
+}
+
+func TestCompoundPackets(t *testing.T) {
+	s := newTestMember(t, "127.0.0.1:9101")
+	s.config = DefaultConfig()
+
+	messages := make([]*Message, 0)
+	for i := 0; i < 10; i++ {
+		messages = append(messages, newMessage(KVSet, make([]byte, 400)))
+	}
+	packets := s.buildCompoundPackets(messages)
+	assert.Greater(t, len(packets), 1)
+
+	received := 0
+	s.messageHandlers = map[MessageType]PacketHandlerFunc{
+		KVSet: func(packet *Packet) { received++ },
+	}
+	s.registerMessageHandler(Compound, s.handleCompound)
+	for _, packet := range packets {
+		s.dispatchPacket(packet)
+	}
+	assert.Equal(t, len(messages), received)
+}
+
+func TestUnversionedPacket(t *testing.T) {
+	s := newTestMember(t, "127.0.0.1:9101")
+	received := 0
+	s.messageHandlers = map[MessageType]PacketHandlerFunc{
+		Ping: func(packet *Packet) {
+			received++
+			assert.Equal(t, protocolBase, packet.Version)
+		},
+	}
+
+	// 加入协议版本之前的数据包格式，没有Label和Version字段
+	from := resolveAddr("127.0.0.1:9102")
+	baseline := struct {
+		MessageBody *Message
+		From        Address
+		To          Address
+	}{newMessage(Ping, nil), from, s.me.Addr()}
+	b, err := codec.Marshal(baseline)
+	assert.NoError(t, err)
+	p := &transport.Packet{From: from.uDPAddr()}
+	p.Buffer.Write(b)
+	s.packetHandler(p)
+	assert.Equal(t, 1, received)
+
+	// 旧节点的成员信息没有协议版本，按基础协议处理
+	assert.True(t, compatibleNodeInfo(&NodeInfoPayload{}))
+	n := newNode(from, nil)
+	n.acceptClaim(&NodeInfoPayload{Addr: from, NodeState: NodeAlive, Signer: from})
+	assert.Equal(t, nodeProtocol{min: protocolBase, max: protocolBase, cur: protocolBase}, n.protocol)
+}
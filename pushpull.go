@@ -2,19 +2,30 @@ package syncmember
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
 	"fmt"
-	"io"
+	"math"
 	"net"
+	"time"
 
 	"github.com/ciiim/syncmember/codec"
 	"github.com/ciiim/syncmember/reader"
 )
 
+var (
+	ErrLabelMismatch = errors.New("cluster label mismatch")
+	ErrUnauthorized  = errors.New("pushPull unauthorized")
+)
+
 func (s *SyncMember) pushPull() {
 	for {
 		select {
-		case <-s.pushPullTicker.C:
+		case <-s.pushPullTicker.C():
 			s.doPushPull()
+			s.gcTombstones()
 		case <-s.stopCh:
 			return
 		}
@@ -22,139 +33,476 @@ func (s *SyncMember) pushPull() {
 }
 
 func (s *SyncMember) doPushPull() {
+	s.nMutex.Lock()
 	target := kRamdonNodes(s.config.PushPullNums, s.nodes, func(n *Node) bool {
 		return !n.IsCredible()
 	})
+	vouched := make([]bool, len(target))
+	for i, node := range target {
+		vouched[i] = node.trusted
+	}
+	s.nMutex.Unlock()
 	if len(target) == 0 {
 		s.logger.Debug("no nodes can pushPull")
 		return
 	}
-	for _, node := range target {
-		remoteNodes, err := s.pushPullNodeInternal(node, s.nodes)
+	for i, node := range target {
+		remoteNodes, remoteKVs, authenticated, err := s.pushPullNode(node, false)
 		if err != nil {
 			s.logger.Error("pushPullNode", "error", err)
 			continue
 		}
-		if err = s.MergeNodes(remoteNodes); err != nil {
+		//对方证明了自己持有JoinSecret时，其发送的节点信息可信
+		if err = s.mergeNodes(remoteNodes, &node.address, vouched[i] || authenticated); err != nil {
 			s.logger.Error("MergeNode", "error", err)
 			continue
 		}
+		s.mergeKV(remoteKVs)
 	}
 }
 
+// pushPullHeader pushPull请求的头部
+// 双方在交换节点信息之前先交换头部，头部校验失败时不会交换节点信息
+type pushPullHeader struct {
+	Version uint8
+	Label   string
+	Error   string
+
+	//发送方可以使用的最高协议版本，双方取较小值决定是否交换KV数据
+	//旧版本节点不会发送该字段，此时为0
+	Protocol uint8
+
+	//配置了JoinSecret时双方都会下发随机挑战，并回复对方挑战的HMAC证明自己持有密钥
+	//响应方在头部中通过Proof应答，发起方确认后再通过pushPullAuth应答
+	Challenge []byte
+	Proof     []byte
+
+	//发送方的键值对数量，双方取较大值决定Merkle树的比较深度
+	Keys int
+}
+
+// pushPullAuth 发起方对挑战的应答
+type pushPullAuth struct {
+	MAC []byte
+}
+
 // TCP
 // 处理pushPull请求
 // 读取远程节点的数据；推送本地节点的数据
 // 不要在这里关闭连接
 func (s *SyncMember) handlepushPull(conn net.Conn) {
 	s.logger.Debug("handlepushPull", "remote addr", conn.RemoteAddr().String())
+	if err := s.extendDeadline(conn); err != nil {
+		s.logger.Error("handlepushPull", "set deadline error", err)
+		return
+	}
 
-	//PULL
-	res, err := io.ReadAll(reader.NewAReader(conn))
+	//HEADER
+	var header pushPullHeader
+	err := readFrame(conn, &header)
 	if err != nil {
+		s.logger.Error("handlepushPull", "read header error", err)
+		return
+	}
+	reply := pushPullHeader{Version: protocolBase, Label: s.config.ClusterLabel, Protocol: s.config.ProtocolVersion, Keys: s.kvCount()}
+	if header.Label != s.config.ClusterLabel {
+		s.logger.Warn("handlepushPull", "refused", "label mismatch", "label", header.Label, "remote addr", conn.RemoteAddr().String())
+		reply.Error = "label mismatch"
+	} else if err := checkProtocolVersion(wireVersion(header.Version)); err != nil {
+		s.logger.Warn("handlepushPull", "refused", err, "remote addr", conn.RemoteAddr().String())
+		reply.Error = err.Error()
+	}
+	if reply.Error != "" {
+		if err := writeFrame(conn, &reply); err != nil {
+			s.logger.Error("handlepushPull", "write header error", err)
+		}
+		return
+	}
+
+	//AUTH
+	if len(s.config.JoinSecret) > 0 {
+		reply.Challenge, err = newChallenge()
+		if err != nil {
+			s.logger.Error("handlepushPull", "challenge error", err)
+			return
+		}
+		//没有挑战的发起方不持有密钥，收到本节点的挑战后会放弃
+		if len(header.Challenge) == challengeBytes {
+			reply.Proof = s.joinMAC(joinRoleResponder, header.Challenge, reply.Challenge)
+		}
+	}
+	if err := writeFrame(conn, &reply); err != nil {
+		s.logger.Error("handlepushPull", "write header error", err)
 		return
 	}
+	if len(reply.Challenge) > 0 {
+		var auth pushPullAuth
+		if err := readFrame(conn, &auth); err != nil {
+			s.logger.Error("handlepushPull", "read auth error", err)
+			return
+		}
+		ack := pushPullHeader{Version: protocolBase, Label: s.config.ClusterLabel}
+		if !hmac.Equal(auth.MAC, s.joinMAC(joinRoleInitiator, header.Challenge, reply.Challenge)) {
+			s.logger.Warn("handlepushPull", "refused", "unauthenticated join", "remote addr", conn.RemoteAddr().String())
+			ack.Error = "unauthorized"
+		}
+		if err := writeFrame(conn, &ack); err != nil {
+			s.logger.Error("handlepushPull", "write ack error", err)
+			return
+		}
+		if ack.Error != "" {
+			return
+		}
+	}
 
-	//unmarshal body
-	var remote []NodeInfoPayload
-	if err := codec.Unmarshal(res, &remote); err != nil {
-		s.logger.Error("handlepushPull", "unmarshal error", err)
+	//PULL
+	remote, err := readNodeInfos(conn)
+	if err != nil {
+		s.logger.Error("handlepushPull", "read error", err)
 		return
 	}
 
 	s.logger.Debug("pushpull received", "num", len(remote))
 
-	if err := s.MergeNodes(remote); err != nil {
+	//发起方通过了HMAC挑战时，其发送的节点信息可信
+	if err := s.mergeNodes(remote, nil, len(reply.Challenge) > 0); err != nil {
 		s.logger.Error("handlepushPull", "merge nodes error", err)
 		return
 	}
 
 	//PUSH
-	nodeinfos := make([]NodeInfoPayload, len(s.nodes)+1)
-	for i, n := range s.nodes {
-		nodeinfos[i] = n.GetInfo()
-	}
-	nodeinfos[len(s.nodes)] = s.me.GetInfo()
-	bufBytes, err := codec.Marshal(nodeinfos)
-	if err != nil {
-		s.logger.Error("handlepushPull", "marshal error", err)
+	if err := writeNodeInfos(conn, s.localNodeInfos(true)); err != nil {
+		s.logger.Error("handlepushPull", "write error", err)
 		return
 	}
-	messageBytes, err := codec.AACoder.Encode(bufBytes)
-	if err != nil {
-		s.logger.Error("handlepushPull", "encode error", err)
+
+	//KV
+	if min(header.Protocol, s.config.ProtocolVersion) < protocolKVSync {
 		return
 	}
-	_, err = conn.Write(messageBytes)
-	if err != nil {
-		s.logger.Error("handlepushPull", "write error", err)
+	if err := s.handleSyncKV(conn, merkleSyncDepth(max(header.Keys, reply.Keys))); err != nil {
+		s.logger.Error("handlepushPull", "sync kv error", err)
 		return
 	}
 }
 
-func (s *SyncMember) pushPullNode(node *Node, join bool) (remote []NodeInfoPayload, err error) {
+func (s *SyncMember) pushPullNode(node *Node, join bool) (remote []NodeInfoPayload, remoteKVs []KeyValuePayload, authenticated bool, err error) {
+	return s.pushPullNodeInternal(node, s.localNodeInfos(join))
+}
+
+// extendDeadline 为下一轮交互重新设置超时
+func (s *SyncMember) extendDeadline(conn net.Conn) error {
+	return conn.SetDeadline(time.Now().Add(s.config.TCPTimeout))
+}
+
+// localNodeInfos 复制本地节点列表的已签名信息，网络交互期间不持有nMutex
+func (s *SyncMember) localNodeInfos(includeMe bool) []NodeInfoPayload {
 	s.nMutex.Lock()
 	defer s.nMutex.Unlock()
-	if join {
-		nodesCopy := make([]*Node, len(s.nodes)+1)
-		copy(nodesCopy, s.nodes)
-		nodesCopy[len(s.nodes)] = s.me
-		return s.pushPullNodeInternal(node, nodesCopy)
+	nodeinfos := make([]NodeInfoPayload, 0, len(s.nodes)+1)
+	for _, n := range s.nodes {
+		nodeinfos = append(nodeinfos, n.signedInfo())
 	}
-	return s.pushPullNodeInternal(node, s.nodes)
+	if includeMe {
+		nodeinfos = append(nodeinfos, s.me.signedInfo())
+	}
+	return nodeinfos
 }
 
 // TCP
 // 发起pushPull请求
 // 推送本地节点的数据；读取远程节点的数据
-func (s *SyncMember) pushPullNodeInternal(node *Node, nodes []*Node) (remote []NodeInfoPayload, err error) {
+// 双方都支持protocolKVSync时，随后通过Merkle树摘要同步KV数据
+// authenticated 对方是否证明了自己持有JoinSecret
+func (s *SyncMember) pushPullNodeInternal(node *Node, nodeinfos []NodeInfoPayload) (remote []NodeInfoPayload, remoteKVs []KeyValuePayload, authenticated bool, err error) {
 	s.logger.Debug("pushPullNode", "target node", node.Addr())
 
-	//PUSH
-	nodeinfos := make([]NodeInfoPayload, len(nodes))
-	for i, n := range nodes {
-		nodeinfos[i] = n.GetInfo()
-	}
-	bufBytes, err := codec.Marshal(nodeinfos)
+	//HEADER
+	conn, err := s.transport.DialStream(node.Addr().String())
 	if err != nil {
 		return
 	}
-	messageBytes, err := codec.AACoder.Encode(bufBytes)
-	if err != nil {
+	defer conn.Close()
+	if err = s.extendDeadline(conn); err != nil {
 		return
 	}
-	buf := bytes.NewBuffer(messageBytes)
-	conn, err := s.tcpTransport.DialAndSendRawBytes(node.Addr().String(), buf)
-	if err != nil {
+	header := pushPullHeader{Version: protocolBase, Label: s.config.ClusterLabel, Protocol: s.config.ProtocolVersion, Keys: s.kvCount()}
+	if len(s.config.JoinSecret) > 0 {
+		if header.Challenge, err = newChallenge(); err != nil {
+			return
+		}
+	}
+	if err = writeFrame(conn, &header); err != nil {
 		return
 	}
-	defer conn.Close()
+	var reply pushPullHeader
+	if err = readFrame(conn, &reply); err != nil {
+		return
+	}
+	if reply.Label != s.config.ClusterLabel {
+		return nil, nil, false, fmt.Errorf("%w: local %q, remote %q", ErrLabelMismatch, s.config.ClusterLabel, reply.Label)
+	}
+	if reply.Error != "" {
+		return nil, nil, false, fmt.Errorf("pushPull refused by %s: %s", node.Addr(), reply.Error)
+	}
+	if err = checkProtocolVersion(wireVersion(reply.Version)); err != nil {
+		return nil, nil, false, err
+	}
+
+	//AUTH
+	if len(reply.Challenge) > 0 {
+		if len(s.config.JoinSecret) == 0 {
+			return nil, nil, false, fmt.Errorf("%w: %s requires a join secret", ErrUnauthorized, node.Addr())
+		}
+		//先确认对方持有密钥，再应答对方的挑战，不向冒充的节点推送数据
+		if !hmac.Equal(reply.Proof, s.joinMAC(joinRoleResponder, header.Challenge, reply.Challenge)) {
+			return nil, nil, false, fmt.Errorf("%w: %s failed the join challenge", ErrUnauthorized, node.Addr())
+		}
+		if err = writeFrame(conn, &pushPullAuth{MAC: s.joinMAC(joinRoleInitiator, header.Challenge, reply.Challenge)}); err != nil {
+			return
+		}
+		var ack pushPullHeader
+		if err = readFrame(conn, &ack); err != nil {
+			return
+		}
+		if ack.Error != "" {
+			return nil, nil, false, fmt.Errorf("%w: refused by %s: %s", ErrUnauthorized, node.Addr(), ack.Error)
+		}
+		authenticated = true
+	} else if len(s.config.JoinSecret) > 0 {
+		// 不向未要求认证的节点推送数据，避免加入错误的集群
+		return nil, nil, false, fmt.Errorf("%w: %s did not challenge", ErrUnauthorized, node.Addr())
+	}
+
+	//PUSH
+	if err = writeNodeInfos(conn, nodeinfos); err != nil {
+		return
+	}
+
 	//PULL
-	buf.Reset()
-	if err = reader.ReadTCPMessage(conn, buf, codec.AACoder); err != nil {
+	if remote, err = readNodeInfos(conn); err != nil {
 		return
 	}
 
-	remote = nodeinfos[:0]
-	if err = codec.Unmarshal(buf.Bytes(), &remote); err != nil {
+	//KV
+	if min(reply.Protocol, s.config.ProtocolVersion) < protocolKVSync {
 		return
 	}
+	start := s.hlc.now(s.clock.Now())
+	if remoteKVs, err = s.syncKV(conn, merkleSyncDepth(max(header.Keys, reply.Keys))); err != nil {
+		return
+	}
+	s.markKVSynced(node.Addr(), start)
 	return
 }
 
+// nodeInfoChunk 节点信息分片
+// 单个消息的长度受ACoder限制，节点较多时需要分多次发送
+type nodeInfoChunk struct {
+	Nodes []NodeInfoPayload
+	More  bool
+}
+
+const (
+	//单个分片的最大估算长度
+	maxChunkBytes = math.MaxInt16 / 2
+	//地址、公钥、签名等字段的估算长度
+	nodeInfoBaseBytes = 256
+)
+
+func writeNodeInfos(conn net.Conn, nodeinfos []NodeInfoPayload) error {
+	for {
+		n, size := 0, 0
+		for n < len(nodeinfos) {
+			size += nodeInfoBaseBytes + len(nodeinfos[n].Meta) + len(nodeinfos[n].Addr.Name)
+			if n > 0 && size > maxChunkBytes {
+				break
+			}
+			n++
+		}
+		chunk := nodeInfoChunk{Nodes: nodeinfos[:n], More: n < len(nodeinfos)}
+		if err := writeFrame(conn, &chunk); err != nil {
+			return err
+		}
+		if !chunk.More {
+			return nil
+		}
+		nodeinfos = nodeinfos[n:]
+	}
+}
+
+func readNodeInfos(conn net.Conn) ([]NodeInfoPayload, error) {
+	var nodeinfos []NodeInfoPayload
+	for {
+		var chunk nodeInfoChunk
+		if err := readFrame(conn, &chunk); err != nil {
+			return nil, err
+		}
+		nodeinfos = append(nodeinfos, chunk.Nodes...)
+		if !chunk.More {
+			return nodeinfos, nil
+		}
+	}
+}
+
+// kvChunk KV数据分片
+type kvChunk struct {
+	Entries []KeyValuePayload
+	More    bool
+}
+
+const (
+	//键值对除键和值以外字段的估算长度
+	kvEntryBaseBytes = 128
+	//超过该长度的键值对无法放入单个消息，不参与同步
+	maxKVEntryBytes = math.MaxInt16 - 64
+	//一次pushPull中每一方发送的键值对的最大估算长度
+	maxSyncKVBytes = 16 << 20
+)
+
+// kvEntrySize 键值对的估算长度
+func kvEntrySize(kv *KeyValuePayload) int {
+	return kvEntryBaseBytes + len(kv.Key) + len(kv.Value)
+}
+
+func writeKVs(conn net.Conn, kvs []KeyValuePayload) error {
+	for {
+		n, size := 0, 0
+		for n < len(kvs) {
+			size += kvEntrySize(&kvs[n])
+			if n > 0 && size > maxChunkBytes {
+				break
+			}
+			n++
+		}
+		chunk := kvChunk{Entries: kvs[:n], More: n < len(kvs)}
+		if err := writeFrame(conn, &chunk); err != nil {
+			return err
+		}
+		if !chunk.More {
+			return nil
+		}
+		kvs = kvs[n:]
+	}
+}
+
+// readKVs 读取对方发送的键值对，总长度超过maxSyncKVBytes时返回错误
+func readKVs(conn net.Conn) ([]KeyValuePayload, error) {
+	var kvs []KeyValuePayload
+	size := 0
+	for {
+		var chunk kvChunk
+		if err := readFrame(conn, &chunk); err != nil {
+			return nil, err
+		}
+		//分片本身也计入长度，避免对方不断发送空分片
+		//正常的分片至少包含一个键值对，因此总长度不超过发送上限的两倍
+		size += kvEntryBaseBytes
+		for i := range chunk.Entries {
+			size += kvEntrySize(&chunk.Entries[i])
+		}
+		if size > 2*maxSyncKVBytes+kvEntryBaseBytes {
+			return nil, fmt.Errorf("kv sync exceeds %d bytes", maxSyncKVBytes)
+		}
+		kvs = append(kvs, chunk.Entries...)
+		if !chunk.More {
+			return kvs, nil
+		}
+	}
+}
+
+// 挑战的长度
+const challengeBytes = 32
+
+// HMAC中区分双方的角色，一方的应答不能被反射给另一方使用
+const (
+	joinRoleInitiator byte = 1
+	joinRoleResponder byte = 2
+)
+
+// newChallenge 生成随机挑战
+func newChallenge() ([]byte, error) {
+	challenge := make([]byte, challengeBytes)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// joinMAC 计算双方挑战的HMAC，角色和集群标签一并参与计算
+func (s *SyncMember) joinMAC(role byte, initiator, responder []byte) []byte {
+	mac := hmac.New(sha256.New, s.config.JoinSecret)
+	mac.Write([]byte{role})
+	mac.Write(initiator)
+	mac.Write(responder)
+	mac.Write([]byte(s.config.ClusterLabel))
+	return mac.Sum(nil)
+}
+
+// admitted 节点是否可以通过UDP与本节点交互
+// 设置JoinSecret时，UDP数据包未经认证，未知节点只能通过pushPull的HMAC挑战加入，
+// 不能通过Gossip添加，Ping也不会得到回复。调用者需要持有nMutex
+func (s *SyncMember) admitted(addr Address) bool {
+	if len(s.config.JoinSecret) == 0 {
+		return true
+	}
+	_, ok := s.nodesMap[addr.String()]
+	return ok
+}
+
+// encodeFrame 编码一个带ACoder头部的消息
+func encodeFrame(v any) ([]byte, error) {
+	bufBytes, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return codec.AACoder.Encode(bufBytes)
+}
+
+func writeFrame(conn net.Conn, v any) error {
+	messageBytes, err := encodeFrame(v)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(messageBytes)
+	return err
+}
+
+func readFrame(conn net.Conn, v any) error {
+	buf := new(bytes.Buffer)
+	if err := reader.ReadTCPMessage(conn, buf, codec.AACoder); err != nil {
+		return err
+	}
+	return codec.Unmarshal(buf.Bytes(), v)
+}
+
+// MergeNodes 合并节点信息，其中的公钥不会被视为可信
 func (s *SyncMember) MergeNodes(remote []NodeInfoPayload) error {
+	return s.mergeNodes(remote, nil, false)
+}
+
+// mergeNodes 合并pushPull收到的节点信息，peer和vouched见trustClaims
+func (s *SyncMember) mergeNodes(remote []NodeInfoPayload, peer *Address, vouched bool) error {
 	if len(remote) == 0 {
 		return nil
 	}
+	s.nMutex.Lock()
+	defer s.nMutex.Unlock()
+	//先处理存活节点，死亡通知的签名者可能在同一个列表中
 	for _, nodeinfo := range remote {
 		switch nodeinfo.NodeState {
 		case NodeAlive:
 			s.alive(&nodeinfo)
-		case NodeDead:
-			s.dead(&nodeinfo)
+		case NodeDead, NodeLeft:
 		default:
 			return fmt.Errorf("MergeNodes Unknown NodeState %d", nodeinfo.NodeState)
 		}
 	}
+	s.trustClaims(remote, peer, vouched)
+	for _, nodeinfo := range remote {
+		if nodeinfo.NodeState == NodeDead || nodeinfo.NodeState == NodeLeft {
+			s.dead(&nodeinfo)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,68 @@
+package syncmember
+
+import (
+	"net"
+	"strconv"
+)
+
+// SenderCheckMode 校验Packet.From与UDP源地址是否一致的方式
+type SenderCheckMode int8
+
+const (
+	// 不校验
+	SenderCheckOff SenderCheckMode = iota
+
+	// 不一致时只记录日志
+	SenderCheckLog
+
+	// 不一致时丢弃数据包
+	SenderCheckStrict
+)
+
+func (m SenderCheckMode) String() string {
+	switch m {
+	case SenderCheckOff:
+		return "Off"
+	case SenderCheckLog:
+		return "Log"
+	case SenderCheckStrict:
+		return "Strict"
+	default:
+		return "Unknown"
+	}
+}
+
+// checkSender 比较Packet中声明的发送者与实际的UDP源地址
+// 处于NAT或使用广播地址的节点，可以通过SenderAllowList声明其转换后的源地址
+func (s *SyncMember) checkSender(packet *Packet, src *net.UDPAddr) bool {
+	if s.config.SenderCheck == SenderCheckOff || src == nil {
+		return true
+	}
+	if packet.From.IP.Equal(src.IP) && packet.From.Port == src.Port {
+		return true
+	}
+	if s.senderTranslated(packet.From, src) {
+		return true
+	}
+	s.logger.Warn("packet sender mismatch", "from", packet.From.String(), "source", src.String(), "mode", s.config.SenderCheck.String())
+	return s.config.SenderCheck != SenderCheckStrict
+}
+
+// senderTranslated 源地址是否在声明地址的允许列表中
+// 允许列表的条目可以是 ip:port，也可以只写 ip 表示任意端口
+func (s *SyncMember) senderTranslated(from Address, src *net.UDPAddr) bool {
+	allowed, ok := s.config.SenderAllowList[from.String()]
+	if !ok {
+		return false
+	}
+	srcAddr := net.JoinHostPort(src.IP.String(), strconv.Itoa(src.Port))
+	for _, a := range allowed {
+		if a == srcAddr {
+			return true
+		}
+		if ip := net.ParseIP(a); ip != nil && ip.Equal(src.IP) {
+			return true
+		}
+	}
+	return false
+}
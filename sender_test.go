@@ -0,0 +1,105 @@
+package syncmember
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ciiim/syncmember/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSender(t *testing.T) {
+	s := newTestMember(t, "127.0.0.1:9101")
+	s.config = DefaultConfig().
+		SetSenderCheck(SenderCheckStrict).
+		AllowSenderTranslation("10.0.0.1:9102", "192.168.1.1")
+
+	packet := newPacket(newPingMessage(), resolveAddr("127.0.0.1:9102"), s.me.Addr())
+	assert.True(t, s.checkSender(packet, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9102}))
+	assert.False(t, s.checkSender(packet, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9103}))
+
+	translated := newPacket(newPingMessage(), resolveAddr("10.0.0.1:9102"), s.me.Addr())
+	assert.True(t, s.checkSender(translated, &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 40000}))
+	assert.False(t, s.checkSender(translated, &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 9102}))
+
+	s.config.SetSenderCheck(SenderCheckLog)
+	assert.True(t, s.checkSender(packet, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9103}))
+}
+
+func TestJoinSecretRefusesUDPAdmission(t *testing.T) {
+	s := newTestMember(t, "127.0.0.1:9101")
+	s.config.SetJoinSecret([]byte("secret"))
+	stranger := newTestMember(t, "127.0.0.1:9102")
+
+	network := transport.NewMemNetwork()
+	useMemTransport(t, s, network)
+	received := captureTransport(t, network, stranger.me.Addr().String())
+
+	// 未通过pushPull认证的节点不能通过Gossip加入，Ping也不会得到回复
+	claim := stranger.me.signedInfo()
+	s.handleStateChange(newMessage(Alive, claim.Encode().Bytes()), stranger.me.Addr())
+	assert.Equal(t, NodeUnknown, s.GetNodeState(stranger.me.Addr().String()))
+	s.handlePing(newPacket(newPingMessage(), stranger.me.Addr(), s.me.Addr()))
+
+	// 通过认证后正常交互
+	assert.NoError(t, s.mergeNodes([]NodeInfoPayload{claim}, nil, true))
+	assert.Equal(t, NodeAlive, s.GetNodeState(stranger.me.Addr().String()))
+	ping := newPingMessage()
+	s.handlePing(newPacket(ping, stranger.me.Addr(), s.me.Addr()))
+	// 第一个收到的Pong回复的是认证之后的Ping
+	pong := nextPacket(t, received)
+	assert.Equal(t, Pong, pong.MessageBody.MsgType)
+	assert.Equal(t, ping.Seq+1, pong.MessageBody.Seq)
+}
+
+func TestJoinSecretMutualChallenge(t *testing.T) {
+	network := transport.NewMemNetwork()
+	s1 := newTestMember(t, "127.0.0.1:9101")
+	s2 := newTestMember(t, "127.0.0.1:9102")
+	s3 := newTestMember(t, "127.0.0.1:9103")
+	for _, s := range []*SyncMember{s1, s2} {
+		s := s
+		s.config.SetJoinSecret([]byte("secret"))
+		useMemTransport(t, s, network)
+		assert.NoError(t, s.transport.Start(s.packetHandler, s.handlepushPull))
+		t.Cleanup(func() { s.transport.Shutdown() })
+	}
+	claim := s3.me.signedInfo()
+	assert.NoError(t, s2.mergeNodes([]NodeInfoPayload{claim}, nil, true))
+
+	// 种子节点证明了自己持有密钥，其转发的节点信息可信
+	assert.NoError(t, s1.Join(s2.me.Addr().String()))
+	assert.True(t, s1.nodesMap[s2.me.Addr().String()].trusted)
+	assert.True(t, s1.nodesMap[s3.me.Addr().String()].trusted)
+
+	// 冒充种子节点，下发挑战但无法应答发起方的挑战
+	impostor, err := network.NewTransport("127.0.0.1:9104")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed := make(chan error, 1)
+	err = impostor.Start(func(*transport.Packet) {}, func(conn net.Conn) {
+		var header pushPullHeader
+		if err := readFrame(conn, &header); err != nil {
+			pushed <- err
+			return
+		}
+		challenge, _ := newChallenge()
+		forged, _ := newChallenge()
+		reply := pushPullHeader{Version: protocolBase, Protocol: ProtocolVersionMax, Challenge: challenge, Proof: forged}
+		if err := writeFrame(conn, &reply); err != nil {
+			pushed <- err
+			return
+		}
+		var auth pushPullAuth
+		pushed <- readFrame(conn, &auth)
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { impostor.Shutdown() })
+
+	err = s1.Join("127.0.0.1:9104")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	// 发起方在确认对方持有密钥之前不会应答挑战，也不会推送节点信息
+	assert.Error(t, <-pushed)
+	assert.Equal(t, NodeUnknown, s1.GetNodeState("127.0.0.1:9104"))
+}
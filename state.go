@@ -1,26 +1,60 @@
 package syncmember
 
+import "errors"
+
 type NodeStateType int8
 
 const (
 	NodeUnknown NodeStateType = iota
 	NodeDead
 	NodeAlive
+	// 节点通过Leave主动离开，其他节点按死亡处理
+	NodeLeft
 )
 
+func (t NodeStateType) String() string {
+	switch t {
+	case NodeDead:
+		return "Dead"
+	case NodeAlive:
+		return "Alive"
+	case NodeLeft:
+		return "Left"
+	default:
+		return "Unknown"
+	}
+}
+
 // 由远程节点发起的状态变更触发
 // 也可以由心跳判断的状态变更触发
+// 调用者需要持有nMutex
 func (s *SyncMember) alive(remoteNodeInfo *NodeInfoPayload) {
 	node, ok := s.nodesMap[remoteNodeInfo.Addr.String()]
 	if equalAddress(remoteNodeInfo.Addr, s.me.address) {
 		return
 	}
+	// 版本等于当前节点版本，若本地副本状态为死亡，设置为存活（反驳）；若本地副本状态为存活，返回
+	// 版本小于当前节点版本的信息已经过期，不能复活节点
+	// 过期的信息无需校验签名
+	if ok && (remoteNodeInfo.Version < node.GetInfo().Version ||
+		remoteNodeInfo.Version == node.GetInfo().Version && node.nodeLocalInfo.nodeState == NodeAlive) {
+		return
+	}
+	if err := s.verifyNodeInfo(remoteNodeInfo); err != nil {
+		s.logger.Warn("Reject alive claim", "node", remoteNodeInfo.Addr.String(), "signer", remoteNodeInfo.Signer.String(), "error", err)
+		return
+	}
+	if !compatibleNodeInfo(remoteNodeInfo) {
+		s.logger.Warn("Reject alive claim", "node", remoteNodeInfo.Addr.String(), "error", "incompatible protocol version",
+			"min", remoteNodeInfo.ProtocolMin, "max", remoteNodeInfo.ProtocolMax)
+		return
+	}
 	// 如果节点不存在，添加节点
 	if !ok {
 		node = newNode(remoteNodeInfo.Addr, remoteNodeInfo)
 		node.changeState(NodeAlive)
-		node.becomeCredible()
-		s.AddNode(node)
+		node.becomeCredible(s.config.Credibility)
+		s.addNode(node)
 
 		if s.nodeEvent != nil {
 			s.nodeEvent.NotifyJoin(node)
@@ -33,38 +67,54 @@ func (s *SyncMember) alive(remoteNodeInfo *NodeInfoPayload) {
 		return
 	}
 
-	// 版本小于等于当前节点版本，若本地副本状态为死亡，设置为存活；若本地副本状态为存活，返回
-	if remoteNodeInfo.Version <= node.GetInfo().Version && node.nodeLocalInfo.nodeState == NodeAlive {
-		return
-	}
 	s.logger.Info("Node Alive", "node", remoteNodeInfo.Addr.String())
 	node.increaseVersionTo(remoteNodeInfo.Version)
+	node.acceptClaim(remoteNodeInfo)
 
 	// 如果节点存在，但是状态不是存活，设置节点状态为存活
 	if node.nodeLocalInfo.nodeState != NodeAlive {
 		node.changeState(NodeAlive)
-		node.becomeCredible()
+		node.becomeCredible(s.config.Credibility)
 
 		if s.nodeEvent != nil {
 			s.nodeEvent.NotifyAlive(node)
 		}
-
-		//广播
-		s.boardcastQueue.PutMessage(Alive, remoteNodeInfo.Addr.String(), remoteNodeInfo.Encode().Bytes())
+		s.reviveEphemeralOwner(node.address)
 	}
+
+	//广播，版本更新可能携带新的元数据，同样需要转发
+	s.boardcastQueue.PutMessage(Alive, remoteNodeInfo.Addr.String(), remoteNodeInfo.Encode().Bytes())
 }
 
 // 由远程节点发起的状态变更触发
 // 也可以由心跳判断的状态变更触发
+// 调用者需要持有nMutex
 func (s *SyncMember) dead(remoteNodeInfo *NodeInfoPayload) {
 	//如果收到的死亡节点是自己，需要反驳
 	if equalAddress(remoteNodeInfo.Addr, s.me.address) {
+		//已经离开集群，不再反驳
+		if s.me.NodeState() == NodeLeft {
+			return
+		}
+		err := s.verifyNodeInfo(remoteNodeInfo)
+
+		//	新加入的节点可能还不认识或还不信任发现者，此时仍然反驳
+		if err != nil && !errors.Is(err, ErrUnknownSigner) && !errors.Is(err, ErrUntrustedSigner) {
+			s.logger.Warn("Reject dead claim", "node", remoteNodeInfo.Addr.String(), "signer", remoteNodeInfo.Signer.String(), "error", err)
+			return
+		}
 
 		//	当集群内的一个节点误认为自己死亡时，会发送Gossip消息通知其他节点
 		//	其他节点也会发送Gossip消息通知其他节点
 		//	该节点会多次收到同样节点版本的死亡通知
-		//	如果该节点收到的死亡通知版本和自己的版本一致，说明该节点已经反驳过了，不需要再次反驳
-		if remoteNodeInfo.Version == s.me.GetInfo().Version {
+		//	如果该节点收到的死亡通知版本不高于自己的版本，说明该节点已经反驳过了，不需要再次反驳
+		if remoteNodeInfo.Version <= s.me.GetInfo().Version {
+			return
+		}
+		//	版本比自己高出maxDeadVersionJump以上的死亡通知不会被其他节点接受，无需反驳，
+		//	也避免伪造的版本号被放大
+		if remoteNodeInfo.Version > s.me.GetInfo().Version+maxDeadVersionJump {
+			s.logger.Warn("Reject dead claim", "node", remoteNodeInfo.Addr.String(), "signer", remoteNodeInfo.Signer.String(), "error", ErrVersionJump)
 			return
 		}
 		//同步版本
@@ -86,29 +136,79 @@ func (s *SyncMember) dead(remoteNodeInfo *NodeInfoPayload) {
 		return
 	}
 
+	//未签名、签名者不可信或版本跳跃过大的死亡通知一律丢弃
+	if err := s.verifyNodeInfo(remoteNodeInfo); err != nil {
+		s.logger.Warn("Reject dead claim", "node", remoteNodeInfo.Addr.String(), "signer", remoteNodeInfo.Signer.String(), "error", err)
+		return
+	}
+
 	s.logger.Info("Node Dead", "node", remoteNodeInfo.Addr.String())
 	node.increaseVersionTo(remoteNodeInfo.Version)
 
-	// 如果节点存在，但是状态不是死亡，设置节点状态为死亡
-	if node.nodeLocalInfo.nodeState != NodeDead {
-		node.changeState(NodeDead)
+	// 如果节点存在，但是状态是存活，设置节点状态为死亡或离开
+	// 离开与死亡的处理相同
+	wasDead := node.nodeLocalInfo.nodeState != NodeAlive
+	node.changeState(remoteNodeInfo.NodeState)
+	if !wasDead {
 		node.becomeUnCredible()
+		delete(s.waitPongMap, node.address.String())
 
 		if s.nodeEvent != nil {
 			s.nodeEvent.NotifyDead(node)
 		}
+		s.deleteEphemeralKV(node.address, node.GetInfo().Version)
+	}
 
+	//离开通知由节点自己签名，原样转发
+	//死亡通知以本节点身份重新签发后转发，接收方只需信任本节点
+	payload := *remoteNodeInfo
+	if remoteNodeInfo.NodeState == NodeLeft {
+		node.acceptClaim(remoteNodeInfo)
+	} else {
+		payload = s.signDead(node)
+	}
+	if !wasDead {
 		//广播
-		s.boardcastQueue.PutMessage(Dead, remoteNodeInfo.Addr.String(), remoteNodeInfo.Encode().Bytes())
+		s.boardcastQueue.PutMessage(Dead, remoteNodeInfo.Addr.String(), payload.Encode().Bytes())
+	}
+}
+
+// Leave 主动离开集群
+// 离开通知由本节点签名，直接发给所有存活节点并通过Gossip转发，
+// 其他节点按死亡处理，删除本节点的临时键值对。之后可以调用Shutdown
+func (s *SyncMember) Leave() {
+	s.nMutex.Lock()
+	defer s.nMutex.Unlock()
+	if s.me.NodeState() == NodeLeft {
+		return
+	}
+	s.me.changeState(NodeLeft)
+	s.me.increaseVersionTo(s.me.GetInfo().Version + 1)
+	payload := s.signSelf()
+	msg := payload.Encode().Bytes()
+	s.boardcastQueue.PutMessage(Dead, s.me.address.Name, msg)
+
+	s.logger.Info("[Leave] Leaving cluster", "node", s.me.address.Name)
+	for _, node := range s.nodes {
+		if node.NodeState() != NodeAlive {
+			continue
+		}
+		packet := newPacket(newMessage(Dead, msg), s.host, node.Addr())
+		if err := s.sendPacket(packet); err != nil {
+			s.logger.Error("SendMsg", "error", err)
+		}
 	}
 }
 
 func (s *SyncMember) refute() {
-	//广播
-	payload := s.me.GetInfo()
+	//广播，反驳信息需要自己签名
+	payload := s.signSelf()
 	s.boardcastQueue.PutMessage(Alive, s.me.address.Name, payload.Encode().Bytes())
 
 	s.logger.Info("[Refute] I'm alive", "node", s.me.address.Name)
+
+	//其他节点可能已删除本节点的临时键值对
+	s.reassertEphemeralKV()
 }
 
 func (s *SyncMember) GetNodeState(addr string) NodeStateType {
@@ -120,3 +220,13 @@ func (s *SyncMember) GetNodeState(addr string) NodeStateType {
 	}
 	return node.nodeLocalInfo.nodeState
 }
+
+// UpdateMeta 更新本节点元数据，签名后广播给其他节点
+func (s *SyncMember) UpdateMeta(meta []byte) {
+	s.nMutex.Lock()
+	defer s.nMutex.Unlock()
+	s.me.meta = meta
+	s.me.increaseVersionTo(s.me.GetInfo().Version + 1)
+	payload := s.signSelf()
+	s.boardcastQueue.PutMessage(Alive, s.me.address.Name, payload.Encode().Bytes())
+}
@@ -4,13 +4,14 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/ciiim/syncmember/clock"
 	"github.com/ciiim/syncmember/codec"
 	"github.com/ciiim/syncmember/transport"
-	"github.com/google/btree"
 )
 
 type SyncMember struct {
@@ -31,19 +32,45 @@ type SyncMember struct {
 
 	logger *slog.Logger
 
-	pingTicker     *time.Ticker
-	pushPullTicker *time.Ticker
-	gossipTicker   *time.Ticker
+	identity *identity
 
-	udpTransport *transport.UDPTransport
-	tcpTransport *transport.TCPTransport
+	clock          clock.Clock
+	pingTicker     clock.Ticker
+	pushPullTicker clock.Ticker
+	gossipTicker   clock.Ticker
+	expireTicker   clock.Ticker
+
+	transport transport.Transport
 
 	boardcastQueue *BoardcastQueue
 
 	//副本
 	//存储用户数据
-	kvcopyTree *btree.BTree
-	kvTreeMu   *sync.RWMutex
+	kvStore  KVStore
+	kvMerkle *kvMerkle
+	//key -> 墓碑
+	tombstones map[string]*kVItem
+	//节点地址 -> 最近一次成功同步KV开始时的本地时间戳
+	kvSyncedAt map[string]uint64
+	//已清理的墓碑中最大的写入时间戳，不晚于它的墓碑不再接收
+	kvGCHorizon uint64
+	//按过期时间排序的key
+	kvExpiry kvExpiryHeap
+	//所属节点地址 -> 临时键值对的key
+	kvEphemeral map[string]map[string]struct{}
+	//已死亡的所属节点地址 -> 死亡通知的版本
+	kvDeadOwners map[string]int64
+	//KV预写日志，未设置DataDir时为空
+	kvWAL          *os.File
+	snapshotTicker clock.Ticker
+
+	//本地KV事件的序号，每个事件加一
+	kvRevision uint64
+	//批量写入期间暂存的watcher事件，批量写入完成后再分发
+	kvBatching     bool
+	kvBatchPending []kvDispatchTask
+	kvTreeMu       *sync.RWMutex
+	hlc            hlc
 
 	messageHandlers map[MessageType]PacketHandlerFunc
 
@@ -59,7 +86,7 @@ func NewSyncMember(nodeName string, config *Config) *SyncMember {
 	s := &SyncMember{
 		config:   config,
 		nodeName: nodeName,
-		stopCh:   make(chan struct{}, 2),
+		stopCh:   make(chan struct{}),
 		stopVar:  new(atomic.Bool),
 
 		nMutex:         new(sync.Mutex),
@@ -107,12 +134,27 @@ func (s *SyncMember) init(config *Config) error {
 		TCPTimeout: s.config.TCPTimeout,
 	}
 
+	s.identity, err = newIdentity(s.config.PrivateKey)
+	if err != nil {
+		return err
+	}
+
 	s.host = s.host.withName(s.nodeName)
 	s.me = newNode(s.host, nil)
-	s.me.setAlive()
+	s.me.publicKey = s.identity.publicKey
+	s.me.meta = s.config.Meta
+	s.me.protocol = nodeProtocol{
+		min: ProtocolVersionMin,
+		max: ProtocolVersionMax,
+		cur: s.config.ProtocolVersion,
+	}
+	s.me.setAlive(s.config.Credibility)
+	s.signSelf()
 
-	s.udpTransport = transport.NewUDPTransport(&udpConfig, s.stopVar)
-	s.tcpTransport = transport.NewTCPTransport(&tcpConfig, s.stopVar, s.handlepushPull)
+	s.transport = s.config.Transport
+	if s.transport == nil {
+		s.transport = transport.NewNetTransport(&udpConfig, &tcpConfig, s.stopVar)
+	}
 
 	s.registerMessageHandler(Ping, s.handlePing)
 	s.registerMessageHandler(Pong, s.handlePong)
@@ -122,19 +164,22 @@ func (s *SyncMember) init(config *Config) error {
 	s.registerMessageHandler(KVSet, s.handleGossip)
 	s.registerMessageHandler(KVDelete, s.handleGossip)
 	s.registerMessageHandler(KVUpdate, s.handleGossip)
+	s.registerMessageHandler(KVBatch, s.handleGossip)
+	s.registerMessageHandler(Compound, s.handleCompound)
+
+	s.openKVStore()
+	if s.config.DataDir != "" {
+		if err := s.loadKVData(); err != nil {
+			s.closeKVData()
+			return err
+		}
+	}
 
-	wg := new(sync.WaitGroup)
-	wg.Add(2)
-
-	//UDP service
-	go s.udpTransport.Handle()
-	go s.udpTransport.Listen(wg)
-
-	//TCP service
-	go s.tcpTransport.Listen(wg)
-
-	wg.Wait()
-
+	if err := s.transport.Start(s.packetHandler, s.handlepushPull); err != nil {
+		//启动失败时使用者拿不到实例，需要在这里关闭日志和存储
+		s.closeKVData()
+		return err
+	}
 	return nil
 }
 
@@ -143,10 +188,13 @@ func (s *SyncMember) Run() error {
 	go s.ping()
 	go s.pushPull()
 	go s.gossip()
+	go s.expire()
+	if s.config.DataDir != "" {
+		go s.snapshot()
+	}
 
 	s.waitShutdown()
 
-	s.stop()
 	return nil
 }
 
@@ -160,16 +208,18 @@ func (s *SyncMember) Join(addr string) error {
 		return fmt.Errorf("can't join self")
 	}
 
-	remote, err := s.pushPullNode(node, true)
+	remote, remoteKVs, authenticated, err := s.pushPullNode(node, true)
 	if err != nil {
 		s.logger.Error("Push Pull Node", "failed", err)
 		return err
 	}
-	err = s.MergeNodes(remote)
+	//种子节点证明了自己持有JoinSecret时，其发送的节点信息可信
+	err = s.mergeNodes(remote, &node.address, authenticated)
 	if err != nil {
 		s.logger.Error("MergeNodes", "failed", err)
 		return err
 	}
+	s.mergeKV(remoteKVs)
 	return nil
 }
 
@@ -200,14 +250,30 @@ func (s *SyncMember) packetHandler(p *transport.Packet) {
 		s.logger.Error("UDPUnmarshal error", "error", err)
 		return
 	}
+	if packet.Label != s.config.ClusterLabel {
+		s.logger.Warn("cluster label mismatch, packet dropped", "label", packet.Label, "from", packet.From, "source", p.From)
+		return
+	}
+	packet.Version = wireVersion(packet.Version)
+	if err := checkProtocolVersion(packet.Version); err != nil {
+		s.logger.Warn("packet dropped", "error", err, "from", packet.From)
+		return
+	}
+	if !s.checkSender(&packet, p.From) {
+		return
+	}
+	s.dispatchPacket(&packet)
+	s.logger.Debug("handle packet done", "packet message type", packet.MessageBody.MsgType, "cost(ms)", float64(time.Since(start).Microseconds())/1000.0)
+}
+
+func (s *SyncMember) dispatchPacket(packet *Packet) {
 	s.logger.Debug("handle packet", "packet message", packet.MessageBody.MsgType)
 	handler, ok := s.messageHandlers[packet.MessageBody.MsgType]
 	if !ok {
 		s.logger.Error("no handler for packet", "message type", packet.MessageBody.MsgType, "from", packet.From)
 		return
 	}
-	handler(&packet)
-	s.logger.Debug("handle packet done", "packet message type", packet.MessageBody.MsgType, "cost(ms)", float64(time.Since(start).Microseconds())/1000.0)
+	handler(packet)
 }
 
 func (s *SyncMember) Node() Address {
@@ -215,12 +281,13 @@ func (s *SyncMember) Node() Address {
 }
 
 func (s *SyncMember) Shutdown() {
-	if s.stopVar.Load() {
+	if s.stopVar.Swap(true) {
 		s.logger.Warn("Already shutdown")
 		return
 	}
 	s.logger.Info("Shutdown...")
-	s.stopCh <- struct{}{}
+	close(s.stopCh)
+	s.stop()
 }
 
 func (s *SyncMember) waitShutdown() {
@@ -228,9 +295,13 @@ func (s *SyncMember) waitShutdown() {
 }
 
 func (s *SyncMember) stop() {
-
-	s.stopVar.Store(true)
 	s.pingTicker.Stop()
 	s.pushPullTicker.Stop()
 	s.gossipTicker.Stop()
+	s.expireTicker.Stop()
+	s.snapshotTicker.Stop()
+	if err := s.transport.Shutdown(); err != nil {
+		s.logger.Error("Shutdown transport", "error", err)
+	}
+	s.closeKVData()
 }
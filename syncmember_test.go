@@ -1 +1,44 @@
 package syncmember_test
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/ciiim/syncmember"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoinLabelMismatch(t *testing.T) {
+	s1 := syncmember.NewSyncMember("node1", syncmember.DefaultConfig().
+		SetPort(9011).SetClusterLabel("staging-a").SetLogLevel(slog.LevelError))
+	s2 := syncmember.NewSyncMember("node2", syncmember.DefaultConfig().
+		SetPort(9012).SetClusterLabel("staging-b").SetLogLevel(slog.LevelError))
+
+	defer s1.Shutdown()
+	defer s2.Shutdown()
+
+	err := s2.Join("127.0.0.1:9011")
+	assert.True(t, errors.Is(err, syncmember.ErrLabelMismatch), "unexpected error %v", err)
+	assert.Equal(t, syncmember.NodeUnknown, s1.GetNodeState(s2.Node().String()))
+}
+
+func TestJoinSecret(t *testing.T) {
+	s1 := syncmember.NewSyncMember("node1", syncmember.DefaultConfig().
+		SetPort(9013).SetJoinSecret([]byte("secret")).SetLogLevel(slog.LevelError))
+	s2 := syncmember.NewSyncMember("node2", syncmember.DefaultConfig().
+		SetPort(9014).SetJoinSecret([]byte("wrong")).SetLogLevel(slog.LevelError))
+	s3 := syncmember.NewSyncMember("node3", syncmember.DefaultConfig().
+		SetPort(9015).SetJoinSecret([]byte("secret")).SetLogLevel(slog.LevelError))
+
+	defer s1.Shutdown()
+	defer s2.Shutdown()
+	defer s3.Shutdown()
+
+	err := s2.Join("127.0.0.1:9013")
+	assert.True(t, errors.Is(err, syncmember.ErrUnauthorized), "unexpected error %v", err)
+	assert.Equal(t, syncmember.NodeUnknown, s1.GetNodeState(s2.Node().String()))
+
+	assert.NoError(t, s3.Join("127.0.0.1:9013"))
+	assert.Equal(t, syncmember.NodeAlive, s1.GetNodeState(s3.Node().String()))
+}
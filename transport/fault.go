@@ -0,0 +1,153 @@
+package transport
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Faults MemNetwork的数据包故障模拟参数，运行时可随时修改
+type Faults struct {
+	// 丢包率 [0, 1]
+	Loss float64
+
+	// 固定延迟与随机抖动，实际延迟为 Latency + [0, Jitter)
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// 重复发送的概率 [0, 1]
+	Duplicate float64
+
+	// 乱序的概率 [0, 1]，被选中的数据包额外延迟ReorderDelay，使其晚于之后发送的数据包到达
+	Reorder      float64
+	ReorderDelay time.Duration
+}
+
+// DefaultReorderDelay 未设置ReorderDelay时使用的乱序延迟
+var DefaultReorderDelay = 10 * time.Millisecond
+
+// faultState 模拟网络的故障状态
+type faultState struct {
+	mu     sync.Mutex
+	rand   *rand.Rand
+	faults Faults
+
+	// addr -> group
+	groups map[string]string
+	// from group -> to group，存在即不可达
+	partitions map[string]map[string]struct{}
+}
+
+func newFaultState() *faultState {
+	return &faultState{
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		groups:     make(map[string]string),
+		partitions: make(map[string]map[string]struct{}),
+	}
+}
+
+// SetFaults 设置数据包故障参数
+func (n *MemNetwork) SetFaults(f Faults) {
+	n.faults.mu.Lock()
+	defer n.faults.mu.Unlock()
+	n.faults.faults = f
+}
+
+// SetSeed 设置故障模拟使用的随机数种子
+func (n *MemNetwork) SetSeed(seed int64) {
+	n.faults.mu.Lock()
+	defer n.faults.mu.Unlock()
+	n.faults.rand = rand.New(rand.NewSource(seed))
+}
+
+// SetGroup 将地址划入名为group的分组，用于模拟分区
+func (n *MemNetwork) SetGroup(group string, addrs ...string) {
+	n.faults.mu.Lock()
+	defer n.faults.mu.Unlock()
+	for _, addr := range addrs {
+		n.faults.groups[addr] = group
+	}
+}
+
+// Partition 阻断from分组到to分组的通信，反方向不受影响
+func (n *MemNetwork) Partition(from, to string) {
+	n.faults.mu.Lock()
+	defer n.faults.mu.Unlock()
+	if n.faults.partitions[from] == nil {
+		n.faults.partitions[from] = make(map[string]struct{})
+	}
+	n.faults.partitions[from][to] = struct{}{}
+}
+
+// PartitionBoth 阻断两个分组之间双向的通信
+func (n *MemNetwork) PartitionBoth(a, b string) {
+	n.Partition(a, b)
+	n.Partition(b, a)
+}
+
+// Heal 恢复from分组到to分组的通信
+func (n *MemNetwork) Heal(from, to string) {
+	n.faults.mu.Lock()
+	defer n.faults.mu.Unlock()
+	delete(n.faults.partitions[from], to)
+}
+
+// HealAll 清除所有分区
+func (n *MemNetwork) HealAll() {
+	n.faults.mu.Lock()
+	defer n.faults.mu.Unlock()
+	n.faults.partitions = make(map[string]map[string]struct{})
+}
+
+// reachable from是否可以到达to
+func (f *faultState) reachable(from, to string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reachableLocked(from, to)
+}
+
+func (f *faultState) reachableLocked(from, to string) bool {
+	fromGroup, ok := f.groups[from]
+	if !ok {
+		return true
+	}
+	toGroup, ok := f.groups[to]
+	if !ok {
+		return true
+	}
+	_, blocked := f.partitions[fromGroup][toGroup]
+	return !blocked
+}
+
+// plan 决定一个数据包的投递方式，返回每份副本的延迟，为空表示丢弃
+func (f *faultState) plan(from, to string) []time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.reachableLocked(from, to) {
+		return nil
+	}
+	faults := f.faults
+	if faults.Loss > 0 && f.rand.Float64() < faults.Loss {
+		return nil
+	}
+	copies := 1
+	if faults.Duplicate > 0 && f.rand.Float64() < faults.Duplicate {
+		copies++
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delay := faults.Latency
+		if faults.Jitter > 0 {
+			delay += time.Duration(f.rand.Int63n(int64(faults.Jitter)))
+		}
+		if faults.Reorder > 0 && f.rand.Float64() < faults.Reorder {
+			if faults.ReorderDelay > 0 {
+				delay += faults.ReorderDelay
+			} else {
+				delay += DefaultReorderDelay
+			}
+		}
+		delays[i] = delay
+	}
+	return delays
+}
@@ -0,0 +1,216 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ciiim/syncmember/clock"
+)
+
+// MemNetwork 进程内的模拟网络
+// 同一个MemNetwork中的MemTransport可以互相通信，不占用任何端口
+// 可以通过SetFaults、Partition等方法模拟丢包、延迟和网络分区
+type MemNetwork struct {
+	mu        sync.RWMutex
+	endpoints map[string]*MemTransport
+
+	// 延迟投递使用的时钟
+	clock clock.Clock
+
+	faults *faultState
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		endpoints: make(map[string]*MemTransport),
+		clock:     clock.Real{},
+		faults:    newFaultState(),
+	}
+}
+
+// SetClock 设置延迟投递使用的时钟，默认为clock.Real
+// 与节点使用同一个clock.Fake时，有延迟的数据包在推进时间后才会到达
+func (n *MemNetwork) SetClock(clk clock.Clock) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.clock = clk
+}
+
+func (n *MemNetwork) getClock() clock.Clock {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.clock
+}
+
+// NewTransport 在网络中创建一个地址为addr(ip:port)的端点
+// addr需要与节点的广播地址一致
+func (n *MemNetwork) NewTransport(addr string) (*MemTransport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.endpoints[udpAddr.String()]; ok {
+		return nil, fmt.Errorf("MemNetwork: address %s already in use", udpAddr)
+	}
+	t := &MemTransport{
+		network:  n,
+		addr:     udpAddr,
+		packetCh: make(chan *Packet, 1024),
+		stopCh:   make(chan struct{}),
+	}
+	n.endpoints[udpAddr.String()] = t
+	return t, nil
+}
+
+func (n *MemNetwork) endpoint(addr string) (*MemTransport, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	t, ok := n.endpoints[addr]
+	return t, ok
+}
+
+func (n *MemNetwork) remove(t *MemTransport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.endpoints[t.addr.String()] == t {
+		delete(n.endpoints, t.addr.String())
+	}
+}
+
+// MemTransport MemNetwork中的一个端点
+type MemTransport struct {
+	network *MemNetwork
+	addr    *net.UDPAddr
+
+	packetHandler func(*Packet)
+	streamHandler func(net.Conn)
+
+	packetCh chan *Packet
+	stopCh   chan struct{}
+	started  atomic.Bool
+	stopped  atomic.Bool
+	stopOnce sync.Once
+}
+
+var _ Transport = (*MemTransport)(nil)
+
+// Addr 返回端点地址
+func (t *MemTransport) Addr() *net.UDPAddr {
+	return t.addr
+}
+
+func (t *MemTransport) Start(packetHandler func(*Packet), streamHandler func(net.Conn)) error {
+	if packetHandler == nil || streamHandler == nil {
+		return fmt.Errorf("MemTransport: nil handler")
+	}
+	if t.stopped.Load() {
+		return fmt.Errorf("MemTransport is stopped")
+	}
+	t.packetHandler = packetHandler
+	t.streamHandler = streamHandler
+	t.started.Store(true)
+	go t.handle()
+	return nil
+}
+
+func (t *MemTransport) handle() {
+	for {
+		select {
+		case packet := <-t.packetCh:
+			t.packetHandler(packet)
+		case <-t.stopCh:
+			return
+		}
+	}
+}
+
+func (t *MemTransport) SendPacket(b []byte, to *net.UDPAddr) error {
+	if t.stopped.Load() {
+		return fmt.Errorf("MemTransport is stopped")
+	}
+	dst, ok := t.network.endpoint(to.String())
+	if !ok {
+		// 与UDP一致，目标不存在时静默丢弃
+		return nil
+	}
+	for _, delay := range t.network.faults.plan(t.addr.String(), dst.addr.String()) {
+		if delay <= 0 {
+			dst.deliver(t.addr, b)
+			continue
+		}
+		clone := make([]byte, len(b))
+		copy(clone, b)
+		// 在发送时开始计时，而不是在协程开始运行时
+		after := t.network.getClock().After(delay)
+		go func() {
+			select {
+			case <-after:
+				dst.deliver(t.addr, clone)
+			case <-dst.stopCh:
+			}
+		}()
+	}
+	return nil
+}
+
+// deliver 将数据包放入接收队列，队列已满或端点已停止时丢弃
+func (t *MemTransport) deliver(from *net.UDPAddr, b []byte) {
+	if !t.started.Load() || t.stopped.Load() {
+		return
+	}
+	packet := &Packet{From: from}
+	packet.Buffer.Write(b)
+	select {
+	case t.packetCh <- packet:
+	default:
+	}
+}
+
+func (t *MemTransport) DialStream(to string) (net.Conn, error) {
+	if t.stopped.Load() {
+		return nil, fmt.Errorf("MemTransport is stopped")
+	}
+	dst, ok := t.network.endpoint(to)
+	if !ok || !dst.started.Load() || dst.stopped.Load() {
+		return nil, fmt.Errorf("MemTransport: dial %s: connection refused", to)
+	}
+	// 数据流需要双向可达
+	if !t.network.faults.reachable(t.addr.String(), dst.addr.String()) ||
+		!t.network.faults.reachable(dst.addr.String(), t.addr.String()) {
+		return nil, fmt.Errorf("MemTransport: dial %s: i/o timeout", to)
+	}
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		dst.streamHandler(&memConn{Conn: remote, local: dst.addr, remote: t.addr})
+	}()
+	return &memConn{Conn: local, local: t.addr, remote: dst.addr}, nil
+}
+
+func (t *MemTransport) Shutdown() error {
+	t.stopOnce.Do(func() {
+		t.stopped.Store(true)
+		close(t.stopCh)
+		t.network.remove(t)
+	})
+	return nil
+}
+
+// memConn 为net.Pipe补充端点地址
+type memConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remote
+}
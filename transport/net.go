@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// NetTransport 基于UDP和TCP的Transport实现
+type NetTransport struct {
+	udpConfig UDPConfig
+	tcpConfig TCPConfig
+
+	udp *UDPTransport
+	tcp *TCPTransport
+
+	stopVar *atomic.Bool
+}
+
+var _ Transport = (*NetTransport)(nil)
+
+func NewNetTransport(udpConfig *UDPConfig, tcpConfig *TCPConfig, stopVar *atomic.Bool) *NetTransport {
+	return &NetTransport{
+		udpConfig: *udpConfig,
+		tcpConfig: *tcpConfig,
+		stopVar:   stopVar,
+	}
+}
+
+func (n *NetTransport) Start(packetHandler func(*Packet), streamHandler func(net.Conn)) error {
+	n.udpConfig.PacketHandler = packetHandler
+	n.udp = NewUDPTransport(&n.udpConfig, n.stopVar)
+	if n.udp == nil {
+		return fmt.Errorf("NetTransport: nil packet handler")
+	}
+	n.tcp = NewTCPTransport(&n.tcpConfig, n.stopVar, streamHandler)
+
+	if err := n.udp.Bind(); err != nil {
+		return err
+	}
+	if err := n.tcp.Bind(); err != nil {
+		n.udp.Close()
+		return err
+	}
+
+	//UDP service
+	go n.udp.Handle()
+	go n.udp.Serve()
+
+	//TCP service
+	go n.tcp.Serve()
+
+	return nil
+}
+
+func (n *NetTransport) SendPacket(b []byte, to *net.UDPAddr) error {
+	return n.udp.SendRaw(b, to)
+}
+
+func (n *NetTransport) DialStream(to string) (net.Conn, error) {
+	return n.tcp.Dial(to)
+}
+
+func (n *NetTransport) Shutdown() error {
+	n.stopVar.Store(true)
+	if n.tcp != nil {
+		n.tcp.Close()
+	}
+	if n.udp != nil {
+		return n.udp.Close()
+	}
+	return nil
+}
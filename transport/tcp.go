@@ -27,7 +27,8 @@ type TCPTransport struct {
 
 	connHandler func(net.Conn)
 
-	stopVar *atomic.Bool
+	stopVar  *atomic.Bool
+	stopOnce sync.Once
 }
 
 func NewTCPTransport(conf *TCPConfig, stopVar *atomic.Bool, handler func(net.Conn)) *TCPTransport {
@@ -40,20 +41,61 @@ func NewTCPTransport(conf *TCPConfig, stopVar *atomic.Bool, handler func(net.Con
 }
 
 func (t *TCPTransport) Listen(wg *sync.WaitGroup) {
+	if err := t.Bind(); err != nil {
+		t.logger.Error("TCPTransport listen error", "error", err)
+		return
+	}
+	wg.Done()
+	t.Serve()
+}
+
+// Bind 绑定监听地址
+func (t *TCPTransport) Bind() error {
 	l, err := net.Listen("tcp", t.config.ListenAddr)
 	if err != nil {
-		t.logger.Error("TCPTransport listen error", err)
+		return err
 	}
 	t.listener = l
 	t.logger.Info("TCPTransport listening", "addr", t.config.ListenAddr)
-	wg.Done()
+	return nil
+}
+
+// Serve 接受连接并交给connHandler处理，需要先调用Bind
+func (t *TCPTransport) Serve() {
 	for {
-		if err = t.accept(); err != nil {
-			t.logger.Error("TCPTransport listen error", err)
+		if err := t.accept(); err != nil {
+			t.logger.Error("TCPTransport listen error", "error", err)
+		}
+		if t.stopVar.Load() {
+			return
 		}
 	}
 }
 
+// Dial 建立TCP连接并设置超时
+func (t *TCPTransport) Dial(to string) (net.Conn, error) {
+	if t.stopVar.Load() {
+		return nil, fmt.Errorf("TCPTransport is stopped")
+	}
+	conn, err := net.DialTimeout("tcp", to, t.config.TCPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetDeadline(time.Now().Add(t.config.TCPTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Close 关闭监听，Listen会在Accept失败后退出
+func (t *TCPTransport) Close() error {
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Close()
+}
+
 // func (t *TCPTransport) SendRawBytes(conn net.Conn, to string, buf *bytes.Buffer) error {
 // 	if t.stopVar.Load() {
 // 		return fmt.Errorf("TCPTransport is stopped")
@@ -92,7 +134,7 @@ func (t *TCPTransport) accept() error {
 	}
 	defer func() {
 		if err := conn.Close(); err != nil {
-			t.logger.Error("TCPTransport conn close error", err)
+			t.logger.Error("TCPTransport conn close error", "error", err)
 		}
 	}()
 	t.connHandler(conn)
@@ -100,6 +142,8 @@ func (t *TCPTransport) accept() error {
 }
 
 func (t *TCPTransport) stopAll() {
-	t.listener.Close()
-	t.logger.Info("TCPTransport stoped")
+	t.stopOnce.Do(func() {
+		t.listener.Close()
+		t.logger.Info("TCPTransport stoped")
+	})
 }
@@ -0,0 +1,25 @@
+package transport
+
+import (
+	"net"
+)
+
+// Transport 节点间通信的抽象
+//
+// 数据包用于Ping、Gossip等不可靠的短消息，数据流用于pushPull等需要可靠传输的交互。
+// 默认实现NetTransport使用UDP和TCP，MemTransport在进程内模拟网络，便于测试。
+type Transport interface {
+	// Start 开始接收数据包和数据流
+	// packetHandler 处理收到的数据包，返回后数据包可能被复用
+	// streamHandler 处理对端发起的数据流，返回后数据流会被关闭
+	Start(packetHandler func(*Packet), streamHandler func(net.Conn)) error
+
+	// SendPacket 向to发送一个数据包
+	SendPacket(b []byte, to *net.UDPAddr) error
+
+	// DialStream 与to建立数据流
+	DialStream(to string) (net.Conn, error)
+
+	// Shutdown 停止接收并释放资源
+	Shutdown() error
+}
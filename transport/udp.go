@@ -34,7 +34,8 @@ type UDPTransport struct {
 
 	packetCh chan *Packet
 
-	stopVar *atomic.Bool
+	stopVar  *atomic.Bool
+	stopOnce sync.Once
 
 	packetPool *sync.Pool
 }
@@ -92,14 +93,27 @@ func (u *UDPTransport) buildPacket(from *net.UDPAddr, buffer []byte) *Packet {
 }
 
 func (u *UDPTransport) Listen(wg *sync.WaitGroup) {
+	if err := u.Bind(); err != nil {
+		u.logger.Error("UDPTransport listen error", "error", err)
+		return
+	}
+	wg.Done()
+	u.Serve()
+}
+
+// Bind 绑定监听地址
+func (u *UDPTransport) Bind() error {
 	var err error
 	u.conn, err = listenUDP(u.config.ListenAddr)
 	if err != nil {
-		u.logger.Error("UDPTransport listen error:", err)
-		return
+		return err
 	}
 	u.logger.Info("UDPTransport listening", "listen addr", u.config.ListenAddr)
-	wg.Done()
+	return nil
+}
+
+// Serve 读取数据包并放入packetCh，需要先调用Bind
+func (u *UDPTransport) Serve() {
 	for {
 		buf := make([]byte, u.config.UDPBuffer)
 		n, addr, err := u.conn.ReadFromUDP(buf)
@@ -108,7 +122,7 @@ func (u *UDPTransport) Listen(wg *sync.WaitGroup) {
 			return
 		}
 		if err != nil {
-			u.logger.Error("UDPTransport read error:", err)
+			u.logger.Error("UDPTransport read error", "error", err)
 			continue
 		}
 		packet := u.buildPacket(addr, buf[:n])
@@ -139,16 +153,26 @@ func (u *UDPTransport) Handle() {
 }
 
 func (u *UDPTransport) stopAll() {
-	u.conn.Close()
-	close(u.packetCh)
-	u.logger.Info("UDPTransport stoped")
+	u.stopOnce.Do(func() {
+		u.conn.Close()
+		close(u.packetCh)
+		u.logger.Info("UDPTransport stoped")
+	})
+}
+
+// Close 关闭UDP连接，Listen会在读取失败后退出
+func (u *UDPTransport) Close() error {
+	if u.conn == nil {
+		return nil
+	}
+	return u.conn.Close()
 }
 
 func (u *UDPTransport) SendRaw(b []byte, to *net.UDPAddr) error {
 	n, err := u.conn.WriteToUDP(b, to)
 	if n != len(b) {
 		errmsg := fmt.Errorf("[WARN] sent %d bytes, expected %d bytes", n, len(b))
-		u.logger.Warn("UDPTransport WARN ", errmsg)
+		u.logger.Warn("UDPTransport WARN", "error", errmsg)
 		return errmsg
 	}
 	return err
@@ -7,21 +7,26 @@ import (
 	"strings"
 
 	"github.com/ciiim/syncmember/codec"
-	"github.com/ciiim/syncmember/transport"
 )
 
-func sendPacket(transport *transport.UDPTransport, packet *Packet) error {
+// sendPacket 为数据包加上集群标签和协议版本后发送
+func (s *SyncMember) sendPacket(packet *Packet) error {
+	packet.Label = s.config.ClusterLabel
+	if packet.Version == 0 {
+		packet.Version = protocolBase
+	}
 	b, err := codec.Marshal(packet)
 	if err != nil {
 		return err
 	}
-	return transport.SendRaw(b, packet.To.uDPAddr())
+	return s.transport.SendPacket(b, packet.To.uDPAddr())
 }
 
 func equalAddress(a, b Address) bool {
 	return a.IP.Equal(b.IP) && a.Port == b.Port
 }
 
+// kRamdonNodes 随机选取至多k个节点，被排除的节点不占用名额
 func kRamdonNodes(k int, nodes []*Node, exclude func(*Node) bool) []*Node {
 	cloneNodes := make([]*Node, len(nodes))
 	copy(cloneNodes, nodes)
@@ -33,7 +38,7 @@ func kRamdonNodes(k int, nodes []*Node, exclude func(*Node) bool) []*Node {
 		k = len(cloneNodes)
 	}
 	pickedNums := 0
-	for i := 0; i < k; i++ {
+	for i := 0; i < len(cloneNodes); i++ {
 		if pickedNums >= k {
 			break
 		}
@@ -0,0 +1,28 @@
+package syncmember
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKRamdonNodesSkipsExcluded(t *testing.T) {
+	nodes := make([]*Node, 10)
+	for i := range nodes {
+		nodes[i] = newNode(resolveAddr(fmt.Sprintf("127.0.0.1:%d", 9100+i)), nil)
+	}
+	// 只有最后三个节点可选，洗牌后排除的节点多数排在前面
+	excluded := func(n *Node) bool {
+		return n.address.Port < 9107
+	}
+	for i := 0; i < 100; i++ {
+		picked := kRamdonNodes(3, nodes, excluded)
+		assert.Len(t, picked, 3)
+		for _, n := range picked {
+			assert.False(t, excluded(n))
+		}
+	}
+	assert.Len(t, kRamdonNodes(5, nodes, excluded), 3)
+	assert.Empty(t, kRamdonNodes(3, nodes, func(*Node) bool { return true }))
+}